@@ -0,0 +1,314 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type AdherenceStatus string
+
+const (
+	AdherenceEarly     AdherenceStatus = "EARLY"
+	AdherenceOnTime    AdherenceStatus = "ON_TIME"
+	AdherenceLate      AdherenceStatus = "LATE"
+	AdherenceNoData    AdherenceStatus = "NO_DATA"
+	AdherenceScheduled AdherenceStatus = "SCHEDULED"
+)
+
+const (
+	// A trip is on time from 1 minute early to 5 minutes late
+	adherenceEarlyLimit = -60
+	adherenceLateLimit  = 300
+	// A position counts as the bus passing a stop when it is this close to it
+	adherenceStopRadius = 150.0
+	// Positions are matched to a scheduled time only inside this window, or
+	// inside half the headway of the route when trips run more often, so a bus
+	// is not matched to the trip before or after its own
+	adherenceWindow = 15 * time.Minute
+)
+
+type TripAdherence struct {
+	IdTrip         string          `json:"id_trip"`
+	IdRoute        string          `json:"id_route"`
+	Route          string          `json:"route"`
+	Headsign       string          `json:"headsign"`
+	IdService      string          `json:"id_service"`
+	IdBus          string          `json:"id_bus,omitempty"`
+	Bus            string          `json:"bus,omitempty"`
+	ScheduledStart string          `json:"scheduled_start"`
+	ScheduledEnd   string          `json:"scheduled_end"`
+	Stops          int             `json:"stops"`
+	StopsObserved  int             `json:"stops_observed"`
+	AverageDelay   int             `json:"average_delay"`
+	MaxDelay       int             `json:"max_delay"`
+	Status         AdherenceStatus `json:"status"`
+}
+
+type scheduledStop struct {
+	Point Point
+	At    time.Time
+}
+
+type observedPosition struct {
+	Point Point
+	At    time.Time
+}
+
+// timeSpan is the time a bus spent running a trip it was matched to.
+type timeSpan struct {
+	From time.Time
+	To   time.Time
+}
+
+func (t timeSpan) contains(at time.Time) bool {
+	return !at.Before(t.From) && !at.After(t.To)
+}
+
+// matchStops finds, for each scheduled stop, the position of the bus at the
+// stop closest to the scheduled time inside the window and returns the delays
+// in seconds with the span they cover. Positions inside the busy spans belong
+// to other trips and are skipped.
+func matchStops(stops []scheduledStop, positions []observedPosition, window time.Duration, busy []timeSpan) ([]int, timeSpan) {
+	var delays []int
+	var span timeSpan
+
+	for _, s := range stops {
+		var at time.Time
+		best := window + 1
+
+		// Positions are in time order, start at the first one inside the window
+		first := sort.Search(len(positions), func(i int) bool {
+			return !positions[i].At.Before(s.At.Add(-window))
+		})
+
+	next:
+		for _, p := range positions[first:] {
+			if p.At.After(s.At.Add(window)) {
+				break
+			}
+
+			for _, b := range busy {
+				if b.contains(p.At) {
+					continue next
+				}
+			}
+
+			if distanceMeters(s.Point, p.Point) > adherenceStopRadius {
+				continue
+			}
+
+			if d := p.At.Sub(s.At).Abs(); d < best {
+				best = d
+				at = p.At
+			}
+		}
+
+		if at.IsZero() {
+			continue
+		}
+
+		delays = append(delays, int(at.Sub(s.At).Seconds()))
+		if span.From.IsZero() || at.Before(span.From) {
+			span.From = at
+		}
+		if at.After(span.To) {
+			span.To = at
+		}
+	}
+
+	return delays, span
+}
+
+// tripWindow is the matching window of the trip: adherenceWindow, or half the
+// time to the closest trip of the same route when that is shorter.
+func tripWindow(trips []TripAdherence, tripStops map[string][]scheduledStop, i int) time.Duration {
+	window := adherenceWindow
+	start := tripStops[trips[i].IdTrip][0].At
+
+	for j := range trips {
+		if j == i || trips[j].IdRoute != trips[i].IdRoute {
+			continue
+		}
+
+		headway := tripStops[trips[j].IdTrip][0].At.Sub(start).Abs()
+		if headway > 0 && headway/2 < window {
+			window = headway / 2
+		}
+	}
+
+	return window
+}
+
+func adherenceStatus(delay int) AdherenceStatus {
+	switch {
+	case delay < adherenceEarlyLimit:
+		return AdherenceEarly
+	case delay > adherenceLateLimit:
+		return AdherenceLate
+	default:
+		return AdherenceOnTime
+	}
+}
+
+// getAdherenceReport compares the positions reported by the buses of each
+// route with the trips scheduled on the day. Trips are taken in order of
+// departure and each is matched to the bus of the route that passed the most
+// of its stops around the scheduled times. A pass of a bus counts for one trip
+// only.
+func getAdherenceReport(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	now := time.Now().In(loc)
+
+	date := c.DefaultQuery("date", now.Format("2006-01-02"))
+	day, err := time.ParseInLocation("2006-01-02", date, loc)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Date must be in the YYYY-MM-DD format"})
+		return
+	}
+
+	IdRoute := c.Query("id_route")
+	if IdRoute != "" && uuid.Validate(IdRoute) != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	rows, err := db.Query("SELECT t.id, t.id_route, r.code, COALESCE(t.headsign, ''), COALESCE(t.id_service, ''), COALESCE(st.arrival_time, st.departure_time), s.lat, s.lng FROM trips t JOIN routes r ON r.id = t.id_route AND r.active IS TRUE JOIN trip_stop_times st ON st.id_trip = t.id JOIN stops s ON s.id = st.id_stop LEFT JOIN service_calendars sc ON sc.id = t.id_service WHERE ($2 = '' OR t.id_route::text = $2) AND COALESCE(st.arrival_time, st.departure_time) IS NOT NULL AND "+serviceRunsCondition("$1")+" ORDER BY t.id, st.sequence", date, IdRoute)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot generate adherence report"})
+		return
+	}
+
+	var trips []TripAdherence
+	tripStops := make(map[string][]scheduledStop)
+
+	for rows.Next() {
+		var t TripAdherence
+		var value string
+		var p Point
+		if err := rows.Scan(&t.IdTrip, &t.IdRoute, &t.Route, &t.Headsign, &t.IdService, &value, &p.Lat, &p.Lng); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		seconds, err := parseGTFSTime(value)
+		if err != nil {
+			continue
+		}
+
+		if len(trips) == 0 || trips[len(trips)-1].IdTrip != t.IdTrip {
+			trips = append(trips, t)
+		}
+		tripStops[t.IdTrip] = append(tripStops[t.IdTrip], scheduledStop{Point: p, At: day.Add(time.Duration(seconds) * time.Second)})
+	}
+	rows.Close()
+
+	sort.SliceStable(trips, func(i, j int) bool {
+		return tripStops[trips[i].IdTrip][0].At.Before(tripStops[trips[j].IdTrip][0].At)
+	})
+
+	// Trips after midnight belong to the service day they started on
+	// Positions count for the route the bus was running when it reported them
+	rows, err = db.Query("SELECT b.id, b.name, bs.id_route, bs.lat, bs.lng, bs.date FROM bus_stats bs JOIN bus b ON b.id = bs.id_bus WHERE bs.id_route IS NOT NULL AND ($3 = '' OR bs.id_route::text = $3) AND bs.date::timestamptz >= $1 AND bs.date::timestamptz < $2 ORDER BY bs.date::timestamptz", day.Add(-adherenceWindow), day.Add(30*time.Hour+adherenceWindow), IdRoute)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot generate adherence report"})
+		return
+	}
+
+	busNames := make(map[string]string)
+	routeBuses := make(map[string]map[string][]observedPosition)
+
+	for rows.Next() {
+		var IdBus, name, IdRouteBus, reported string
+		var p Point
+		if err := rows.Scan(&IdBus, &name, &IdRouteBus, &p.Lat, &p.Lng, &reported); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		at, err := parseDateString(reported)
+		if err != nil {
+			continue
+		}
+
+		busNames[IdBus] = name
+		if routeBuses[IdRouteBus] == nil {
+			routeBuses[IdRouteBus] = make(map[string][]observedPosition)
+		}
+		routeBuses[IdRouteBus][IdBus] = append(routeBuses[IdRouteBus][IdBus], observedPosition{Point: p, At: at})
+	}
+	rows.Close()
+
+	summary := map[AdherenceStatus]int{AdherenceEarly: 0, AdherenceOnTime: 0, AdherenceLate: 0, AdherenceNoData: 0, AdherenceScheduled: 0}
+	busy := make(map[string][]timeSpan)
+
+	for i := range trips {
+		t := &trips[i]
+		stops := tripStops[t.IdTrip]
+		window := tripWindow(trips, tripStops, i)
+
+		t.Stops = len(stops)
+		t.ScheduledStart = createDateString(stops[0].At)
+		t.ScheduledEnd = createDateString(stops[len(stops)-1].At)
+
+		var bestDelays []int
+		var bestSpan timeSpan
+		for IdBus, positions := range routeBuses[t.IdRoute] {
+			delays, span := matchStops(stops, positions, window, busy[IdBus])
+			if len(delays) > len(bestDelays) || (len(delays) == len(bestDelays) && len(delays) > 0 && IdBus < t.IdBus) {
+				bestDelays = delays
+				bestSpan = span
+				t.IdBus = IdBus
+				t.Bus = busNames[IdBus]
+			}
+		}
+
+		if len(bestDelays) > 0 {
+			busy[t.IdBus] = append(busy[t.IdBus], bestSpan)
+		}
+
+		if len(bestDelays) == 0 {
+			if stops[0].At.After(now) {
+				t.Status = AdherenceScheduled
+			} else {
+				t.Status = AdherenceNoData
+			}
+			summary[t.Status]++
+			continue
+		}
+
+		total := 0
+		for j, d := range bestDelays {
+			total += d
+			if j == 0 || math.Abs(float64(d)) > math.Abs(float64(t.MaxDelay)) {
+				t.MaxDelay = d
+			}
+		}
+
+		t.StopsObserved = len(bestDelays)
+		t.AverageDelay = int(math.Round(float64(total) / float64(len(bestDelays))))
+		t.Status = adherenceStatus(t.AverageDelay)
+		summary[t.Status]++
+	}
+
+	observed := summary[AdherenceEarly] + summary[AdherenceOnTime] + summary[AdherenceLate]
+	onTime := 0.0
+	if observed > 0 {
+		onTime = math.Round(float64(summary[AdherenceOnTime])*1000/float64(observed)) / 10
+	}
+
+	if trips == nil {
+		trips = []TripAdherence{}
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"date": date, "summary": summary, "on_time_percentage": onTime, "trips": trips})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type AnonymousCard struct {
+	Uid   string  `json:"uid" binding:"required"`
+	Value float64 `json:"value" binding:"gte=0"`
+}
+
+type AnonymousCardClaim struct {
+	Uid       string `json:"uid" binding:"required"`
+	ClaimCode string `json:"claim_code" binding:"required"`
+}
+
+type CardTopUp struct {
+	Value float64            `json:"value" binding:"required,gt=0"`
+	Type  BalanceHistoryType `json:"type" binding:"required,oneof=PIX CREDIT_CARD CASH"`
+}
+
+type CardBalanceHistory struct {
+	ID         string             `json:"id"`
+	Uid        string             `json:"uid"`
+	OldBalance float64            `json:"old_balance"`
+	Balance    float64            `json:"balance"`
+	Value      float64            `json:"value"`
+	Type       BalanceHistoryType `json:"type"`
+	Date       string             `json:"date"`
+}
+
+func insertCardBalanceHistory(uid string, oldBalance float64, balance float64, value float64, balanceType BalanceHistoryType) error {
+	return insertCardBalanceHistoryTx(db, uid, oldBalance, balance, value, balanceType)
+}
+
+func insertCardBalanceHistoryTx(q dbExecutor, uid string, oldBalance float64, balance float64, value float64, balanceType BalanceHistoryType) error {
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	_, err := q.Exec("INSERT INTO card_balance_history (id, uid, old_balance, balance, value, type, date) VALUES ($1, $2, $3, $4, $5, $6, $7)", uuid.New(), uid, oldBalance, balance, value, balanceType, createDateString(time))
+	return err
+}
+
+// claimCodeAlphabet leaves out letters and digits that are easy to mix up when
+// the code is read from the receipt.
+const claimCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newClaimCode creates the code handed out with an anonymous card. It proves
+// the card is held by whoever claims its balance.
+func newClaimCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = claimCodeAlphabet[int(b[i])%len(claimCodeAlphabet)]
+	}
+
+	return string(b), nil
+}
+
+// createAnonymousFare charges a fare straight from the balance stored on a card
+// that is not linked to any user.
+func createAnonymousFare(c *gin.Context, bus Bus, card Uid) {
+	var balance float64
+	row := db.QueryRow("UPDATE uids SET balance = balance - $1 WHERE uid = $2 AND id_user IS NULL AND balance >= $1 RETURNING balance", bus.Fare, card.Uid)
+
+	if err := row.Scan(&balance); err != nil {
+		if err == sql.ErrNoRows {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "INSUFFICIENT_BALANCE", "message": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", card.Balance)}})
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", card.Balance)})
+			return
+		} else {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+			return
+		}
+	}
+
+	if err := insertCardBalanceHistory(card.Uid, (balance + bus.Fare), balance, -bus.Fare, FarePayment); err != nil {
+		log.Println(err)
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	id_fare := uuid.New()
+
+	if _, err := db.Exec("INSERT INTO fares (id, id_bus, uid, fare, date, id_shift, id_driver) VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::uuid, NULLIF($7, '')::uuid)", id_fare, bus.ID, card.Uid, bus.Fare, createDateString(time), bus.IdShift, bus.IdDriver); err != nil {
+		log.Println(err)
+	}
+
+	if err := openJourney(db, bus, card, "", id_fare.String(), bus.Fare, nil); err != nil {
+		log.Println(err)
+	}
+
+	hub.BroadcastToID(bus.ID, gin.H{"type": "success", "anonymous": true, "image": "", "name": "Cartão avulso", "surname": "", "fare": bus.Fare, "tap_out": bus.TapOut, "old_balance": (balance + bus.Fare), "balance": balance})
+	c.IndentedJSON(http.StatusOK, gin.H{"anonymous": true, "uid": card.Uid, "fare": bus.Fare, "old_balance": (balance + bus.Fare), "balance": balance})
+}
+
+func issueAnonymousCard(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var card AnonymousCard
+
+	if err := c.ShouldBindJSON(&card); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	uid, err := normalizeUID(card.Uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + card.Uid, "errors": err.Error()})
+		return
+	}
+
+	claimCode, err := newClaimCode()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot issue card with UID: " + uid})
+		return
+	}
+
+	claimCodeHash, err := HashPassword(claimCode)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot issue card with UID: " + uid})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	_, err = db.Exec("INSERT INTO uids (uid, status, balance, claim_code, date) VALUES ($1, $2, $3, $4, $5)", uid, CardActive, card.Value, claimCodeHash, createDateString(time))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Card already exists with UID: " + uid})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot issue card with UID: " + uid})
+		return
+	}
+
+	if card.Value > 0 {
+		if err := insertCardBalanceHistory(uid, 0, card.Value, card.Value, Cash); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// The claim code is only shown here, it is stored hashed like a password
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Anonymous card successfully issued!", "uid": uid, "balance": card.Value, "claim_code": claimCode})
+}
+
+func topUpAnonymousCard(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var topUp CardTopUp
+
+	if err := c.ShouldBindJSON(&topUp); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	var balance float64
+	row := db.QueryRow("UPDATE uids SET balance = balance + $1 WHERE uid = $2 AND id_user IS NULL AND status = $3 RETURNING balance", topUp.Value, uid, CardActive)
+
+	if err := row.Scan(&balance); err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No active anonymous card found with UID: " + uid})
+			return
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot top up card with UID: " + uid})
+			return
+		}
+	}
+
+	if err := insertCardBalanceHistory(uid, (balance - topUp.Value), balance, topUp.Value, topUp.Type); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Card successfully topped up!", "uid": uid, "old_balance": (balance - topUp.Value), "balance": balance})
+}
+
+func getAnonymousCardHistory(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	rows, err := db.Query("SELECT id, uid, old_balance, balance, value, type, date FROM card_balance_history WHERE uid = $1 ORDER BY date DESC", uid)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var history []CardBalanceHistory
+	for rows.Next() {
+		var h CardBalanceHistory
+		err := rows.Scan(&h.ID, &h.Uid, &h.OldBalance, &h.Balance, &h.Value, &h.Type, &h.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		history = append(history, h)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, history)
+}
+
+// claimAnonymousCard links an anonymous card to the logged user and moves the
+// balance left on the card into the personal wallet. The claim code issued with
+// the card is required, knowing the UID is not enough to take its balance.
+func claimAnonymousCard(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var card AnonymousCardClaim
+
+	if err := c.ShouldBindJSON(&card); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	uid, err := normalizeUID(card.Uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + card.Uid, "errors": err.Error()})
+		return
+	}
+
+	// The card is only linked and zeroed if its balance reaches the wallet
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot claim card with UID: " + uid})
+		return
+	}
+	defer tx.Rollback()
+
+	var claimCodeHash string
+	row := tx.QueryRow("SELECT COALESCE(claim_code, '') FROM uids WHERE uid = $1 AND id_user IS NULL AND status = $2 FOR UPDATE", uid, CardActive)
+
+	if err := row.Scan(&claimCodeHash); err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Nenhum cartão avulso ativo encontrado com este UID"})
+			return
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot claim card with UID: " + uid})
+			return
+		}
+	}
+
+	if claimCodeHash == "" || !VerifyPassword(strings.ToUpper(strings.TrimSpace(card.ClaimCode)), claimCodeHash) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Código de resgate inválido"})
+		return
+	}
+
+	// Zeroing the card in the same statement keeps its balance from being spent twice
+	var cardBalance float64
+	row = tx.QueryRow("UPDATE uids u SET id_user = $1, balance = 0 FROM (SELECT uid, balance FROM uids WHERE uid = $2 FOR UPDATE) old WHERE u.uid = old.uid AND u.id_user IS NULL AND u.status = $3 RETURNING old.balance", IdUserToken, uid, CardActive)
+
+	if err := row.Scan(&cardBalance); err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Nenhum cartão avulso ativo encontrado com este UID"})
+			return
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot claim card with UID: " + uid})
+			return
+		}
+	}
+
+	if cardBalance > 0 {
+		if err := insertCardBalanceHistoryTx(tx, uid, cardBalance, 0, -cardBalance, CardClaim); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot claim card with UID: " + uid})
+			return
+		}
+
+		if _, err := creditWalletUserTx(tx, IdUserToken, PersonalWallet, cardBalance, CardClaim); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot claim card with UID: " + uid})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot claim card with UID: " + uid})
+		return
+	}
+
+	balance, err := getBalanceUser(IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Cartão vinculado com sucesso!", "uid": uid, "transferred": cardBalance, "balance": balance})
+}
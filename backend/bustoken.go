@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Each validator authenticates with a token of its own bus. Only its SHA-256
+// is stored, the token is shown once when it is created.
+func hashBusToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyBusToken reports whether the Authorization header carries the token
+// of the bus.
+func verifyBusToken(header string, IdBus string) (bool, error) {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return false, nil
+	}
+
+	var hash string
+	row := db.QueryRow("SELECT COALESCE(token, '') FROM bus WHERE id = $1 AND deleted_at IS NULL", IdBus)
+
+	if err := row.Scan(&hash); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if hash == "" {
+		return false, nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashBusToken(token))) == 1, nil
+}
+
+// BusAuthMiddleware lets through the validator of the bus in the :id param.
+func BusAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, err := verifyBusToken(c.Request.Header.Get("Authorization"), c.Param("id"))
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot verify bus token"})
+			return
+		}
+
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing bus token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// createBusToken issues a new token for the validator of the bus. The token it
+// had before stops working.
+func createBusToken(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create token for bus with ID: " + id})
+		return
+	}
+	token := hex.EncodeToString(b)
+
+	result, err := db.Exec("UPDATE bus SET token = $1 WHERE id = $2 AND deleted_at IS NULL", hashBusToken(token), id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create token for bus with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No bus found with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Bus token successfully created!", "id": id, "token": token})
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type CardStatus string
+
+const (
+	CardActive   CardStatus = "ACTIVE"
+	CardBlocked  CardStatus = "BLOCKED"
+	CardLost     CardStatus = "LOST"
+	CardReplaced CardStatus = "REPLACED"
+)
+
+type CardStatusUpdate struct {
+	Status CardStatus `json:"status" binding:"required,oneof=ACTIVE BLOCKED LOST REPLACED"`
+}
+
+type CardReplace struct {
+	Uid string `json:"uid" binding:"required"`
+}
+
+type CardSettings struct {
+	Label           string  `json:"label" binding:"lte=40"`
+	DailySpendLimit float64 `json:"daily_spend_limit" binding:"gte=0"`
+	DailyRideLimit  int     `json:"daily_ride_limit" binding:"gte=0"`
+}
+
+type CardLink struct {
+	Uid    string `json:"uid" binding:"required"`
+	IdUser string `json:"id_user" binding:"required,uuid"`
+	Force  bool   `json:"force"`
+}
+
+var ErrCardLinked = fmt.Errorf("card already linked")
+var ErrCardAnonymous = fmt.Errorf("card is anonymous")
+
+// linkCardUser links a card to a user. A card that already belongs to someone
+// else is only moved when force is set, which is reserved for admins.
+func linkCardUser(uid string, IdUser string, force bool) error {
+	return linkCardUserTx(db, uid, IdUser, force)
+}
+
+func linkCardUserTx(q dbExecutor, uid string, IdUser string, force bool) error {
+	var owner string
+	err := q.QueryRow("SELECT COALESCE(id_user::text, '') FROM uids WHERE uid = $1", uid).Scan(&owner)
+
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil {
+		// Anonymous cards carry their own balance and must be claimed instead
+		if owner == "" {
+			return ErrCardAnonymous
+		}
+
+		if owner == IdUser || !force {
+			return ErrCardLinked
+		}
+
+		if _, err := q.Exec("UPDATE uids SET id_user = $1, status = $2, replaced_by = NULL WHERE uid = $3", IdUser, CardActive, uid); err != nil {
+			return err
+		}
+
+		// The card is already linked, a stale inventory status is not worth failing for
+		if err := activateInventoryCard(q, uid, IdUser); err != nil {
+			log.Println(err)
+		}
+		return nil
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	_, err = q.Exec("INSERT INTO uids (uid, id_user, status, date) VALUES ($1, $2, $3, $4)", uid, IdUser, CardActive, createDateString(time))
+
+	// Another request linked the same card in the meantime
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrCardLinked
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := activateInventoryCard(q, uid, IdUser); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// normalizeUID turns the UID sent by a reader into the canonical upper-case hex
+// form the ESP32 validator uses. Hex may come in any case, with ':', '-' or
+// spaces between bytes and an optional 0x prefix. Strings made only of digits
+// are read as hex when they have the length of a hex UID and as a big-endian
+// decimal number otherwise. Only 4, 7 and 10 byte MIFARE UIDs are accepted.
+func normalizeUID(raw string) (string, error) {
+	uid := strings.ToUpper(strings.TrimSpace(raw))
+	uid = strings.TrimPrefix(uid, "0X")
+	uid = strings.NewReplacer(":", "", "-", "", " ", "").Replace(uid)
+
+	if uid == "" {
+		return "", fmt.Errorf("uid is empty")
+	}
+
+	validHexLength := func(n int) bool { return n == 8 || n == 14 || n == 20 }
+
+	if isDigits(uid) && !validHexLength(len(uid)) {
+		n, ok := new(big.Int).SetString(uid, 10)
+		if !ok {
+			return "", fmt.Errorf("uid is not a valid decimal number")
+		}
+
+		b := n.Bytes()
+		size := 0
+		for _, l := range []int{4, 7, 10} {
+			if len(b) <= l {
+				size = l
+				break
+			}
+		}
+		if size == 0 {
+			return "", fmt.Errorf("decimal uid is larger than 10 bytes")
+		}
+
+		return fmt.Sprintf("%0*X", size*2, n), nil
+	}
+
+	if _, err := hex.DecodeString(uid); err != nil {
+		return "", fmt.Errorf("uid must be hexadecimal or decimal")
+	}
+
+	if !validHexLength(len(uid)) {
+		return "", fmt.Errorf("uid must have 4, 7 or 10 bytes, got %d hex digits", len(uid))
+	}
+
+	return uid, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkCardLimits tells which daily limit of the card, if any, would be
+// exceeded by one more ride charging the given value. Days follow BRT.
+func checkCardLimits(card Uid, charge float64) (string, error) {
+	if card.DailyRideLimit == 0 && card.DailySpendLimit == 0 {
+		return "", nil
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	now := time.Now().In(loc)
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	var rides int
+	var spent float64
+	row := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(f.fare), 0) FROM fares f WHERE f.uid = $1 AND f.date::timestamptz >= $2", card.Uid, startOfDay)
+
+	if err := row.Scan(&rides, &spent); err != nil {
+		return "", err
+	}
+
+	if card.DailyRideLimit > 0 && rides+1 > card.DailyRideLimit {
+		return "DAILY_RIDE_LIMIT", nil
+	}
+
+	if card.DailySpendLimit > 0 && charge > 0 && spent+charge > card.DailySpendLimit+0.000001 {
+		return "DAILY_SPEND_LIMIT", nil
+	}
+
+	return "", nil
+}
+
+func getCardsUser(IdUser string) ([]Uid, error) {
+	rows, err := db.Query("SELECT uid, id_user, COALESCE(label, ''), status, COALESCE(replaced_by, ''), COALESCE(daily_spend_limit, 0), COALESCE(daily_ride_limit, 0), date FROM uids WHERE id_user = $1 ORDER BY date", IdUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cards []Uid
+	for rows.Next() {
+		var u Uid
+		if err := rows.Scan(&u.Uid, &u.IdUser, &u.Label, &u.Status, &u.ReplacedBy, &u.DailySpendLimit, &u.DailyRideLimit, &u.Date); err != nil {
+			return nil, err
+		}
+		cards = append(cards, u)
+	}
+
+	return cards, rows.Err()
+}
+
+func getCardsByUser(c *gin.Context) {
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	cards, err := getCardsUser(IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, cards)
+}
+
+func linkCardByUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var card Uid
+
+	if err := c.ShouldBindJSON(&card); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	uid, err := normalizeUID(card.Uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + card.Uid, "errors": err.Error()})
+		return
+	}
+
+	if err := linkCardUser(uid, IdUserToken, false); err != nil {
+		if err == ErrCardLinked {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Este cartão já está vinculado a uma conta"})
+			return
+		}
+		if err == ErrCardAnonymous {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Este cartão é avulso, utilize o resgate de cartão"})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot link card with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Cartão vinculado com sucesso!", "uid": uid})
+}
+
+func unlinkCardByUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	// Lost cards stay linked so whoever finds them cannot claim them
+	result, err := db.Exec("DELETE FROM uids WHERE uid = $1 AND id_user = $2 AND status <> $3", uid, IdUserToken, CardLost)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot unlink card with UID: " + uid})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Cartão desvinculado com sucesso!"})
+}
+
+func getCards(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	uid := c.Query("uid")
+	if uid != "" {
+		normalized, err := normalizeUID(uid)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + uid, "errors": err.Error()})
+			return
+		}
+		uid = normalized
+	}
+
+	IdUser := c.Query("id_user")
+
+	if IdUser != "" && uuid.Validate(IdUser) != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	rows, err := db.Query("SELECT uid, COALESCE(id_user::text, ''), status, COALESCE(replaced_by, ''), balance, date FROM uids WHERE ($1 = '' OR uid = $1) AND ($2 = '' OR id_user::text = $2) ORDER BY date DESC", uid, IdUser)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var cards []Uid
+	for rows.Next() {
+		var u Uid
+		err := rows.Scan(&u.Uid, &u.IdUser, &u.Status, &u.ReplacedBy, &u.Balance, &u.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		cards = append(cards, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, cards)
+}
+
+func linkCard(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var card CardLink
+
+	if err := c.ShouldBindJSON(&card); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", card.IdUser).Scan(&exists); err != nil {
+		log.Println(err)
+	}
+
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + card.IdUser})
+		return
+	}
+
+	uid, err := normalizeUID(card.Uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + card.Uid, "errors": err.Error()})
+		return
+	}
+
+	if err := linkCardUser(uid, card.IdUser, card.Force); err != nil {
+		if err == ErrCardLinked {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Card already linked with UID: " + uid})
+			return
+		}
+		if err == ErrCardAnonymous {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Card is anonymous, it must be claimed with UID: " + uid})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot link card with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Card successfully linked!", "uid": uid, "id_user": card.IdUser})
+}
+
+func unlinkCard(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM uids WHERE uid = $1", uid)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot unlink card with UID: " + uid})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Card successfully unlinked!"})
+}
+
+// setCardStatusUser moves a card of the user to a new status, only when the
+// card is currently in one of the allowed statuses.
+func setCardStatusUser(uid string, IdUser string, from []CardStatus, to CardStatus) (bool, error) {
+	allowed := Map(from, func(s CardStatus) string { return string(s) })
+
+	result, err := db.Exec("UPDATE uids SET status = $1 WHERE uid = $2 AND id_user = $3 AND status = ANY($4)", to, uid, IdUser, pq.Array(allowed))
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func updateCardStatusByUser(c *gin.Context, from []CardStatus, to CardStatus, message string) {
+	c.Header("Content-Type", "application/json")
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	updated, err := setCardStatusUser(uid, IdUserToken, from, to)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update card with UID: " + uid})
+		return
+	}
+
+	if !updated {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No card that can be updated found with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": message, "uid": uid, "status": to})
+}
+
+func reportLostCardByUser(c *gin.Context) {
+	updateCardStatusByUser(c, []CardStatus{CardActive, CardBlocked}, CardLost, "Cartão marcado como perdido!")
+}
+
+func blockCardByUser(c *gin.Context) {
+	updateCardStatusByUser(c, []CardStatus{CardActive}, CardBlocked, "Cartão bloqueado com sucesso!")
+}
+
+func unblockCardByUser(c *gin.Context) {
+	updateCardStatusByUser(c, []CardStatus{CardBlocked}, CardActive, "Cartão desbloqueado com sucesso!")
+}
+
+// replaceCardByUser retires a card and links a new UID to the same account, so
+// the balance follows the rider to the new card.
+func replaceCardByUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var replace CardReplace
+
+	if err := c.ShouldBindJSON(&replace); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+	newUid, err := normalizeUID(replace.Uid)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + replace.Uid, "errors": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot replace card with UID: " + uid})
+		return
+	}
+	defer tx.Rollback()
+
+	var card Uid
+	row := tx.QueryRow("SELECT uid, status FROM uids WHERE uid = $1 AND id_user = $2 FOR UPDATE", uid, IdUserToken)
+
+	err_card := row.Scan(&card.Uid, &card.Status)
+
+	if err_card != nil {
+		if err_card == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with UID: " + uid})
+			return
+		} else {
+			log.Println(err_card)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot replace card with UID: " + uid})
+			return
+		}
+	}
+
+	if card.Status == CardReplaced {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Este cartão já foi substituído"})
+		return
+	}
+
+	if err := linkCardUserTx(tx, newUid, IdUserToken, false); err != nil {
+		if err == ErrCardLinked || err == ErrCardAnonymous {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "O novo cartão já está vinculado a uma conta"})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot link card with UID: " + newUid})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE uids SET status = $1, replaced_by = $2 WHERE uid = $3", CardReplaced, newUid, uid); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot replace card with UID: " + uid})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot replace card with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Cartão substituído com sucesso!", "old_uid": uid, "uid": newUid})
+}
+
+func updateCardStatus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var update CardStatusUpdate
+
+	if err := c.ShouldBindJSON(&update); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	result, err := db.Exec("UPDATE uids SET status = $1 WHERE uid = $2", update.Status, uid)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update card with UID: " + uid})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Card status successfully updated!", "uid": uid, "status": update.Status})
+}
+
+func updateCardByUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var settings CardSettings
+
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	result, err := db.Exec("UPDATE uids SET label = $1, daily_spend_limit = $2, daily_ride_limit = $3 WHERE uid = $4 AND id_user = $5", strings.TrimSpace(settings.Label), settings.DailySpendLimit, settings.DailyRideLimit, uid, IdUserToken)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update card with UID: " + uid})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Cartão atualizado com sucesso!", "uid": uid})
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type Driver struct {
+	ID           string `json:"id,omitempty"`
+	Name         string `json:"name" binding:"required,lte=100"`
+	Registration string `json:"registration" binding:"required,lte=20"`
+	Pin          string `json:"pin,omitempty" binding:"required,numeric,min=4,max=6"`
+	Uid          string `json:"uid,omitempty"`
+	Active       bool   `json:"active"`
+}
+
+type DriverLogin struct {
+	Registration string `json:"registration" binding:"required_without=Uid"`
+	Pin          string `json:"pin" binding:"required_with=Registration"`
+	Uid          string `json:"uid" binding:"required_without=Registration"`
+}
+
+type Shift struct {
+	ID        string  `json:"id"`
+	IdDriver  string  `json:"id_driver"`
+	Driver    string  `json:"driver,omitempty"`
+	IdBus     string  `json:"id_bus"`
+	Bus       string  `json:"bus,omitempty"`
+	StartedAt string  `json:"started_at"`
+	EndedAt   string  `json:"ended_at,omitempty"`
+	Fares     int     `json:"fares"`
+	Revenue   float64 `json:"revenue"`
+}
+
+// getOpenShift returns the shift in progress on the bus, if any.
+func getOpenShift(IdBus string) (Shift, error) {
+	var shift Shift
+	row := db.QueryRow("SELECT s.id, s.id_driver, d.name, s.id_bus, s.started_at FROM shifts s JOIN drivers d ON d.id = s.id_driver WHERE s.id_bus = $1 AND s.ended_at IS NULL", IdBus)
+
+	err := row.Scan(&shift.ID, &shift.IdDriver, &shift.Driver, &shift.IdBus, &shift.StartedAt)
+	return shift, err
+}
+
+// startShift opens a shift of the driver on the bus. Any shift left open on
+// the bus or by the driver on another bus is closed first.
+func startShift(driver Driver, bus Bus) (Shift, error) {
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return Shift{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE shifts SET ended_at = $1 WHERE (id_bus = $2 OR id_driver = $3) AND ended_at IS NULL", createDateString(time), bus.ID, driver.ID); err != nil {
+		return Shift{}, err
+	}
+
+	shift := Shift{ID: uuid.New().String(), IdDriver: driver.ID, Driver: driver.Name, IdBus: bus.ID, Bus: bus.Name, StartedAt: createDateString(time)}
+
+	if _, err := tx.Exec("INSERT INTO shifts (id, id_driver, id_bus, started_at) VALUES ($1, $2, $3, $4)", shift.ID, shift.IdDriver, shift.IdBus, shift.StartedAt); err != nil {
+		return Shift{}, err
+	}
+
+	return shift, tx.Commit()
+}
+
+func endShift(IdShift string) (string, error) {
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	_, err := db.Exec("UPDATE shifts SET ended_at = $1 WHERE id = $2 AND ended_at IS NULL", createDateString(time), IdShift)
+	return createDateString(time), err
+}
+
+func findDriverByUid(uid string) (Driver, error) {
+	var driver Driver
+	row := db.QueryRow("SELECT id, name, registration FROM drivers WHERE uid = $1 AND active IS TRUE", uid)
+
+	err := row.Scan(&driver.ID, &driver.Name, &driver.Registration)
+	return driver, err
+}
+
+// toggleDriverShift handles a driver badge tapped on the validator: it starts
+// a shift, or ends it when the same driver is already on duty on this bus.
+func toggleDriverShift(c *gin.Context, bus Bus, driver Driver) {
+	if bus.IdDriver == driver.ID {
+		endedAt, err := endShift(bus.IdShift)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot end shift"})
+			return
+		}
+
+		hub.BroadcastToID(bus.ID, gin.H{"type": "shift_ended", "driver": driver.Name, "message": "Turno encerrado, até logo " + driver.Name})
+		c.IndentedJSON(http.StatusOK, gin.H{"message": "Shift successfully ended!", "id": bus.IdShift, "ended_at": endedAt})
+		return
+	}
+
+	shift, err := startShift(driver, bus)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot start shift"})
+		return
+	}
+
+	hub.BroadcastToID(bus.ID, gin.H{"type": "shift_started", "driver": driver.Name, "message": "Bom trabalho, " + driver.Name})
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Shift successfully started!", "shift": shift})
+}
+
+func getDrivers(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT id, name, registration, COALESCE(uid, ''), active FROM drivers ORDER BY name")
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var drivers []Driver
+	for rows.Next() {
+		var d Driver
+		err := rows.Scan(&d.ID, &d.Name, &d.Registration, &d.Uid, &d.Active)
+		if err != nil {
+			log.Println(err)
+		}
+		drivers = append(drivers, d)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, drivers)
+}
+
+func createDriver(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var driver Driver
+
+	if err := c.ShouldBindJSON(&driver); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if driver.Uid != "" {
+		uid, err := normalizeUID(driver.Uid)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + driver.Uid, "errors": err.Error()})
+			return
+		}
+		driver.Uid = uid
+
+		// A badge that is also a rider card would start a shift on every ride
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM uids WHERE uid = $1)", uid).Scan(&exists); err != nil {
+			log.Println(err)
+		}
+
+		if exists {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "UID is already used by a rider card: " + uid})
+			return
+		}
+	}
+
+	id_driver := uuid.New()
+	hashPin, _ := HashPassword(driver.Pin)
+
+	_, err := db.Exec("INSERT INTO drivers (id, name, registration, pin, uid, active) VALUES ($1, $2, $3, $4, NULLIF($5, ''), TRUE)", id_driver, strings.TrimSpace(driver.Name), strings.TrimSpace(driver.Registration), hashPin, driver.Uid)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Driver already exists with this registration or UID"})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create driver"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Driver successfully created!", "id": id_driver})
+}
+
+func deactivateDriver(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE drivers SET active = FALSE WHERE id = $1", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	if _, err := db.Exec("UPDATE shifts SET ended_at = $1 WHERE id_driver = $2 AND ended_at IS NULL", createDateString(time), id); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Driver successfully deactivated!"})
+}
+
+// getShifts lists shifts with the fares charged during each one, optionally
+// filtered by driver or bus.
+func getShifts(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	IdDriver := c.Query("id_driver")
+	IdBus := c.Query("id_bus")
+
+	if (IdDriver != "" && uuid.Validate(IdDriver) != nil) || (IdBus != "" && uuid.Validate(IdBus) != nil) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	rows, err := db.Query("SELECT s.id, s.id_driver, d.name, s.id_bus, b.name, s.started_at, COALESCE(s.ended_at, ''), COUNT(f.id), COALESCE(SUM(f.fare), 0) FROM shifts s JOIN drivers d ON d.id = s.id_driver JOIN bus b ON b.id = s.id_bus LEFT JOIN fares f ON f.id_shift = s.id WHERE ($1 = '' OR s.id_driver::text = $1) AND ($2 = '' OR s.id_bus::text = $2) GROUP BY s.id, d.name, b.name ORDER BY s.started_at DESC", IdDriver, IdBus)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var shifts []Shift
+	for rows.Next() {
+		var s Shift
+		err := rows.Scan(&s.ID, &s.IdDriver, &s.Driver, &s.IdBus, &s.Bus, &s.StartedAt, &s.EndedAt, &s.Fares, &s.Revenue)
+		if err != nil {
+			log.Println(err)
+		}
+		shifts = append(shifts, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, shifts)
+}
+
+func getShiftByBus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	shift, err := getOpenShift(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No shift in progress on bus with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, shift)
+}
+
+// startShiftByBus logs a driver in on the validator of the bus with the
+// registration and PIN typed on the keypad, or with the driver badge UID.
+func startShiftByBus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var login DriverLogin
+
+	if err := c.ShouldBindJSON(&login); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	var bus Bus
+	row_bus := db.QueryRow("SELECT id, name FROM bus WHERE id = $1 AND deleted_at IS NULL", id)
+
+	err_bus := row_bus.Scan(&bus.ID, &bus.Name)
+
+	if err_bus != nil {
+		if err_bus == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No bus found with ID: " + id})
+			return
+		} else {
+			log.Println(err_bus)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot start shift"})
+			return
+		}
+	}
+
+	var driver Driver
+	var err error
+
+	if login.Uid != "" {
+		uid, err_uid := normalizeUID(login.Uid)
+		if err_uid != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + login.Uid, "errors": err_uid.Error()})
+			return
+		}
+		driver, err = findDriverByUid(uid)
+	} else {
+		if !pinLimiter.Allow(login.Registration, bus.ID) {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TOO_MANY_ATTEMPTS", "message": "Muitas tentativas, aguarde alguns minutos"}})
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many wrong PINs, try again later"})
+			return
+		}
+
+		row := db.QueryRow("SELECT id, name, registration, pin FROM drivers WHERE registration = $1 AND active IS TRUE", login.Registration)
+		err = row.Scan(&driver.ID, &driver.Name, &driver.Registration, &driver.Pin)
+		if err == nil && !VerifyPassword(login.Pin, driver.Pin) {
+			err = sql.ErrNoRows
+		}
+
+		if err == sql.ErrNoRows {
+			pinLimiter.Fail(login.Registration, bus.ID)
+		} else if err == nil {
+			pinLimiter.Reset(login.Registration)
+		}
+	}
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "DRIVER_NOT_FOUND", "message": "Matrícula ou PIN incorretos"}})
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Matrícula ou PIN incorretos"})
+			return
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot start shift"})
+			return
+		}
+	}
+
+	shift, err := startShift(driver, bus)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot start shift"})
+		return
+	}
+
+	hub.BroadcastToID(bus.ID, gin.H{"type": "shift_started", "driver": driver.Name, "message": "Bom trabalho, " + driver.Name})
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Shift successfully started!", "shift": shift})
+}
+
+func endShiftByBus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	shift, err := getOpenShift(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No shift in progress on bus with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot end shift"})
+			return
+		}
+	}
+
+	endedAt, err := endShift(shift.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot end shift"})
+		return
+	}
+
+	hub.BroadcastToID(id, gin.H{"type": "shift_ended", "driver": shift.Driver, "message": "Turno encerrado, até logo " + shift.Driver})
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Shift successfully ended!", "id": shift.ID, "ended_at": endedAt})
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+type Employer struct {
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name" binding:"required,gte=4"`
+	Cnpj   string `json:"cnpj" binding:"required,gte=14,lte=14,numeric"`
+	Email  string `json:"email" binding:"required,email"`
+	Active bool   `json:"active"`
+	Date   string `json:"date,omitempty"`
+}
+
+type EmployerAdmin struct {
+	ID         string `json:"id,omitempty"`
+	IdEmployer string `json:"id_employer,omitempty"`
+	Name       string `json:"name" binding:"required,gte=4"`
+	Email      string `json:"email" binding:"required,email"`
+	Password   string `json:"password" binding:"required,gte=8"`
+}
+
+type Employee struct {
+	ID           string `json:"id,omitempty"`
+	IdEmployer   string `json:"id_employer,omitempty"`
+	IdUser       string `json:"id_user,omitempty"`
+	Cpf          string `json:"cpf" binding:"required,gte=11,lte=11"`
+	Registration string `json:"registration"`
+	Name         string `json:"name,omitempty"`
+	Surname      string `json:"surname,omitempty"`
+	Active       bool   `json:"active"`
+	Date         string `json:"date,omitempty"`
+}
+
+type EmployeeCredit struct {
+	Cpf   string  `json:"cpf" binding:"required"`
+	Value float64 `json:"value" binding:"required"`
+}
+
+type BulkCredit struct {
+	Credits []EmployeeCredit `json:"credits" binding:"required,min=1,dive"`
+}
+
+type EmployerInvoice struct {
+	ID         string                `json:"id"`
+	IdEmployer string                `json:"id_employer"`
+	Employees  int                   `json:"employees"`
+	Total      float64               `json:"total"`
+	Date       string                `json:"date"`
+	Items      []EmployerInvoiceItem `json:"items,omitempty"`
+}
+
+type EmployerInvoiceItem struct {
+	IdUser  string  `json:"id_user"`
+	Cpf     string  `json:"cpf"`
+	Name    string  `json:"name"`
+	Surname string  `json:"surname"`
+	Value   float64 `json:"value"`
+}
+
+func EmployerAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, exists := c.Get("token")
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+
+		token, ok := v.(string)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+
+		role, err := getRoleFromToken(token)
+		if err != nil || role != "EMPLOYER" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Employer access required"})
+			return
+		}
+
+		IdAdminToken, err := getUserIDFromToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+			return
+		}
+
+		var IdEmployer string
+		row := db.QueryRow("SELECT ea.id_employer FROM employer_admins ea JOIN employers e ON e.id = ea.id_employer WHERE ea.id = $1 AND e.active IS TRUE", IdAdminToken)
+
+		if err := row.Scan(&IdEmployer); err != nil {
+			if err != sql.ErrNoRows {
+				log.Println(err)
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Employer access required"})
+			return
+		}
+
+		c.Set("id_employer", IdEmployer)
+		c.Next()
+	}
+}
+
+func getEmployers(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT id, name, cnpj, email, active, date FROM employers ORDER BY name")
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var employers []Employer
+	for rows.Next() {
+		var e Employer
+		err := rows.Scan(&e.ID, &e.Name, &e.Cnpj, &e.Email, &e.Active, &e.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		employers = append(employers, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, employers)
+}
+
+func createEmployer(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var employer Employer
+
+	if err := c.ShouldBindJSON(&employer); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM employers WHERE cnpj = $1)", employer.Cnpj).Scan(&exists); err != nil {
+		log.Println(err)
+	}
+
+	if exists {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Employer already exists with CNPJ: " + employer.Cnpj})
+		return
+	}
+
+	stmt, err := db.Prepare("INSERT INTO employers (id, name, cnpj, email, active, date) VALUES ($1, $2, $3, $4, TRUE, $5)")
+	if err != nil {
+		log.Println(err)
+	}
+	defer stmt.Close()
+
+	id_employer := uuid.New()
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	if _, err := stmt.Exec(id_employer, employer.Name, employer.Cnpj, employer.Email, createDateString(time)); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Employer successfully created!", "id": id_employer})
+}
+
+func createEmployerAdmin(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var employerAdmin EmployerAdmin
+
+	if err := c.ShouldBindJSON(&employerAdmin); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM employers WHERE id = $1)", id).Scan(&exists); err != nil {
+		log.Println(err)
+	}
+
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM employer_admins WHERE email = $1)", employerAdmin.Email).Scan(&exists); err != nil {
+		log.Println(err)
+	}
+
+	if exists {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Employer admin already exists with email: " + employerAdmin.Email})
+		return
+	}
+
+	stmt, err := db.Prepare("INSERT INTO employer_admins (id, id_employer, name, email, password) VALUES ($1, $2, $3, $4, $5)")
+	if err != nil {
+		log.Println(err)
+	}
+	defer stmt.Close()
+
+	id_employer_admin := uuid.New()
+	hashPassword, _ := HashPassword(employerAdmin.Password)
+
+	if _, err := stmt.Exec(id_employer_admin, id, employerAdmin.Name, employerAdmin.Email, hashPassword); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Employer admin successfully created!", "id": id_employer_admin})
+}
+
+func signInEmployer(c *gin.Context) {
+	var login Login
+
+	if err := c.ShouldBindJSON(&login); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	var employerAdmin EmployerAdmin
+	var employer Employer
+	row := db.QueryRow("SELECT ea.id, ea.id_employer, ea.name, ea.password, e.name FROM employer_admins ea JOIN employers e ON e.id = ea.id_employer WHERE ea.email = $1 AND e.active IS TRUE", login.Login)
+
+	err_admin := row.Scan(&employerAdmin.ID, &employerAdmin.IdEmployer, &employerAdmin.Name, &employerAdmin.Password, &employer.Name)
+
+	if err_admin != nil {
+		if err_admin == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Login ou Senha estão incorretos!"})
+			return
+		} else {
+			log.Println(err_admin)
+		}
+	}
+
+	if VerifyPassword(login.Password, employerAdmin.Password) {
+		token, _ := createToken(employerAdmin.ID, "EMPLOYER")
+		c.IndentedJSON(http.StatusOK, gin.H{"id": employerAdmin.ID, "id_employer": employerAdmin.IdEmployer, "name": employerAdmin.Name, "employer": employer.Name, "role": "EMPLOYER", "token": token})
+	} else {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Login ou Senha estão incorretos!"})
+	}
+}
+
+func getEmployees(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	IdEmployer := c.GetString("id_employer")
+
+	rows, err := db.Query("SELECT ee.id, ee.id_employer, ee.id_user, us.cpf, ee.registration, us.name, us.surname, ee.active, ee.date FROM employer_employees ee JOIN users us ON us.id = ee.id_user WHERE ee.id_employer = $1 ORDER BY us.name", IdEmployer)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var employees []Employee
+	for rows.Next() {
+		var e Employee
+		err := rows.Scan(&e.ID, &e.IdEmployer, &e.IdUser, &e.Cpf, &e.Registration, &e.Name, &e.Surname, &e.Active, &e.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		employees = append(employees, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, employees)
+}
+
+func createEmployee(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	IdEmployer := c.GetString("id_employer")
+
+	var employee Employee
+
+	if err := c.ShouldBindJSON(&employee); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if !validateCPF(employee.Cpf) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid CPF: " + employee.Cpf})
+		return
+	}
+
+	var user User
+	row_user := db.QueryRow("SELECT id FROM users WHERE role = $1 AND cpf = $2", "USER", employee.Cpf)
+
+	err_user := row_user.Scan(&user.ID)
+
+	if err_user != nil {
+		if err_user == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No passenger account found with CPF: " + employee.Cpf})
+			return
+		} else {
+			log.Println(err_user)
+		}
+	}
+
+	// Re-adding someone who left the roster reactivates the old entry
+	result, err := db.Exec("UPDATE employer_employees SET active = TRUE, registration = $1 WHERE id_employer = $2 AND id_user = $3", employee.Registration, IdEmployer, user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if result != nil {
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			c.IndentedJSON(http.StatusOK, gin.H{"message": "Employee successfully reactivated!", "id_user": user.ID})
+			return
+		}
+	}
+
+	stmt, err := db.Prepare("INSERT INTO employer_employees (id, id_employer, id_user, registration, active, date) VALUES ($1, $2, $3, $4, TRUE, $5)")
+	if err != nil {
+		log.Println(err)
+	}
+	defer stmt.Close()
+
+	id_employee := uuid.New()
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	if _, err := stmt.Exec(id_employee, IdEmployer, user.ID, employee.Registration, createDateString(time)); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Employee successfully created!", "id": id_employee, "id_user": user.ID})
+}
+
+func deleteEmployee(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	IdEmployer := c.GetString("id_employer")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE employer_employees SET active = FALSE WHERE id = $1 AND id_employer = $2", id, IdEmployer)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Employee successfully removed!"})
+}
+
+// creditEmployees validates every line before crediting anything, so a
+// spreadsheet with a single bad row is rejected as a whole.
+func creditEmployees(c *gin.Context, IdEmployer string, credits []EmployeeCredit) {
+	rows, err := db.Query("SELECT us.id, us.cpf, us.name, us.surname FROM employer_employees ee JOIN users us ON us.id = ee.id_user WHERE ee.id_employer = $1 AND ee.active IS TRUE", IdEmployer)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	roster := make(map[string]EmployerInvoiceItem)
+	for rows.Next() {
+		var item EmployerInvoiceItem
+		if err := rows.Scan(&item.IdUser, &item.Cpf, &item.Name, &item.Surname); err != nil {
+			log.Println(err)
+		}
+		roster[item.Cpf] = item
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+	}
+
+	var errorMessages []string
+	var items []EmployerInvoiceItem
+	seen := make(map[string]bool)
+
+	for i, credit := range credits {
+		line := i + 1
+		item, ok := roster[credit.Cpf]
+
+		if !ok {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: CPF '%s' is not an active employee", line, credit.Cpf))
+			continue
+		}
+		if credit.Value <= 0 {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: value must be greater than zero", line))
+			continue
+		}
+		if seen[credit.Cpf] {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: CPF '%s' is duplicated", line, credit.Cpf))
+			continue
+		}
+
+		seen[credit.Cpf] = true
+		item.Value = credit.Value
+		items = append(items, item)
+	}
+
+	if len(errorMessages) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid credits", "errors": errorMessages})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	invoice := EmployerInvoice{ID: uuid.New().String(), IdEmployer: IdEmployer, Date: createDateString(time)}
+
+	for _, item := range items {
+		invoice.Total += item.Value
+	}
+	invoice.Employees = len(items)
+
+	// The invoice is only issued when every employee got the credit
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create invoice"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO employer_invoices (id, id_employer, employees, total, date) VALUES ($1, $2, $3, $4, $5)", invoice.ID, invoice.IdEmployer, invoice.Employees, invoice.Total, invoice.Date); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create invoice"})
+		return
+	}
+
+	for _, item := range items {
+		if _, err := creditWalletUserTx(tx, item.IdUser, ValeTransporteWallet, item.Value, EmployerCredit); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create invoice"})
+			return
+		}
+
+		if _, err := tx.Exec("INSERT INTO employer_invoice_items (id, id_invoice, id_user, value) VALUES ($1, $2, $3, $4)", uuid.New(), invoice.ID, item.IdUser, item.Value); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create invoice"})
+			return
+		}
+
+		invoice.Items = append(invoice.Items, item)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create invoice"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, invoice)
+}
+
+func createBulkCredit(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var bulkCredit BulkCredit
+
+	if err := c.ShouldBindJSON(&bulkCredit); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	creditEmployees(c, c.GetString("id_employer"), bulkCredit.Credits)
+}
+
+// createBulkCreditCSV accepts a "file" upload with cpf and value columns,
+// separated by comma or semicolon, with an optional header line.
+func createBulkCreditCSV(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Field 'file' is required"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot read uploaded file"})
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot read uploaded file"})
+		return
+	}
+
+	reader := csv.NewReader(bytes.NewReader(content))
+	firstLine, _, _ := strings.Cut(string(content), "\n")
+	if strings.Contains(firstLine, ";") {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid CSV file", "errors": err.Error()})
+		return
+	}
+
+	if len(records) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "cpf") {
+		records = records[1:]
+	}
+
+	if len(records) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "CSV file has no credits"})
+		return
+	}
+
+	var errorMessages []string
+	credits := make([]EmployeeCredit, len(records))
+
+	for i, record := range records {
+		cpf := strings.NewReplacer(".", "", "-", "").Replace(strings.TrimSpace(record[0]))
+		value, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(record[1]), ",", ".", 1), 64)
+		if err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: invalid value '%s'", i+1, record[1]))
+			continue
+		}
+		credits[i] = EmployeeCredit{Cpf: cpf, Value: value}
+	}
+
+	if len(errorMessages) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid credits", "errors": errorMessages})
+		return
+	}
+
+	creditEmployees(c, c.GetString("id_employer"), credits)
+}
+
+func getEmployerInvoices(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	IdEmployer := c.GetString("id_employer")
+
+	rows, err := db.Query("SELECT id, id_employer, employees, total, date FROM employer_invoices WHERE id_employer = $1 ORDER BY date DESC", IdEmployer)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var invoices []EmployerInvoice
+	for rows.Next() {
+		var i EmployerInvoice
+		err := rows.Scan(&i.ID, &i.IdEmployer, &i.Employees, &i.Total, &i.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		invoices = append(invoices, i)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, invoices)
+}
+
+func getEmployerInvoice(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	IdEmployer := c.GetString("id_employer")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var invoice EmployerInvoice
+	row := db.QueryRow("SELECT id, id_employer, employees, total, date FROM employer_invoices WHERE id = $1 AND id_employer = $2", id, IdEmployer)
+
+	err := row.Scan(&invoice.ID, &invoice.IdEmployer, &invoice.Employees, &invoice.Total, &invoice.Date)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+		}
+	}
+
+	rows, err := db.Query("SELECT ii.id_user, us.cpf, us.name, us.surname, ii.value FROM employer_invoice_items ii JOIN users us ON us.id = ii.id_user WHERE ii.id_invoice = $1 ORDER BY us.name", id)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item EmployerInvoiceItem
+		err := rows.Scan(&item.IdUser, &item.Cpf, &item.Name, &item.Surname, &item.Value)
+		if err != nil {
+			log.Println(err)
+		}
+		invoice.Items = append(invoice.Items, item)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, invoice)
+}
@@ -0,0 +1,921 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+)
+
+// Import reports are capped so a broken feed does not produce a huge response
+const gtfsMaxErrors = 200
+
+type GTFSAgency struct {
+	ID       string
+	Name     string
+	URL      string
+	Timezone string
+	Lang     string
+	Phone    string
+}
+
+type GTFSRoute struct {
+	ID        string
+	AgencyID  string
+	ShortName string
+	LongName  string
+	Color     string
+}
+
+type GTFSStop struct {
+	ID         string
+	Code       string
+	Name       string
+	Lat        float64
+	Lng        float64
+	Wheelchair bool
+}
+
+type GTFSTrip struct {
+	ID        string
+	RouteID   string
+	ServiceID string
+	Headsign  string
+	Direction RouteDirection
+	ShapeID   string
+}
+
+type GTFSStopTime struct {
+	TripID    string
+	StopID    string
+	Sequence  int
+	Arrival   string
+	Departure string
+}
+
+type GTFSCalendar struct {
+	ServiceID string
+	Days      [7]bool
+	StartDate string
+	EndDate   string
+}
+
+type GTFSFeed struct {
+	Agencies  []GTFSAgency
+	Routes    []GTFSRoute
+	Stops     []GTFSStop
+	Trips     []GTFSTrip
+	StopTimes map[string][]GTFSStopTime
+	Calendars []GTFSCalendar
+	Shapes    map[string][]Point
+}
+
+type GTFSReport struct {
+	Agencies  int      `json:"agencies"`
+	Routes    int      `json:"routes"`
+	Stops     int      `json:"stops"`
+	Trips     int      `json:"trips"`
+	StopTimes int      `json:"stop_times"`
+	Calendars int      `json:"calendars"`
+	Errors    []string `json:"errors,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+func (r *GTFSReport) errorf(format string, a ...any) {
+	if len(r.Errors) < gtfsMaxErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, a...))
+	}
+}
+
+func (r *GTFSReport) warnf(format string, a ...any) {
+	if len(r.Warnings) < gtfsMaxErrors {
+		r.Warnings = append(r.Warnings, fmt.Sprintf(format, a...))
+	}
+}
+
+var gtfsColorRegex = regexp.MustCompile(`^[0-9A-Fa-f]{6}$`)
+
+// readGTFSFile returns the rows of a feed file keyed by column name, with the
+// line number of each row in the file. Missing files return nil rows.
+func readGTFSFile(files map[string]*zip.File, name string) ([]map[string]string, []int, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var rows []map[string]string
+	var lines []int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(column)] = strings.TrimSpace(record[i])
+			}
+		}
+		rows = append(rows, row)
+		lines = append(lines, line)
+	}
+
+	return rows, lines, nil
+}
+
+// parseGTFSTime reads an HH:MM:SS time, which may go past 24:00:00 for trips
+// that run after midnight, and returns the seconds since the service day began.
+func parseGTFSTime(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time '%s'", value)
+	}
+
+	var total int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || (i > 0 && n > 59) {
+			return 0, fmt.Errorf("invalid time '%s'", value)
+		}
+		total = total*60 + n
+	}
+
+	return total, nil
+}
+
+func formatGTFSTime(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, (seconds/60)%60, seconds%60)
+}
+
+// parseGTFSDate turns a YYYYMMDD date into the YYYY-MM-DD form stored here.
+func parseGTFSDate(value string) (string, error) {
+	if len(value) != 8 || !isDigits(value) {
+		return "", fmt.Errorf("invalid date '%s'", value)
+	}
+	return value[0:4] + "-" + value[4:6] + "-" + value[6:8], nil
+}
+
+// parseGTFS reads and cross-checks the feed. The feed is only usable when the
+// report has no errors.
+func parseGTFS(zr *zip.Reader) (*GTFSFeed, *GTFSReport) {
+	report := &GTFSReport{}
+	feed := &GTFSFeed{StopTimes: make(map[string][]GTFSStopTime), Shapes: make(map[string][]Point)}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		// Some producers zip the folder instead of the files
+		name := f.Name[strings.LastIndex(f.Name, "/")+1:]
+		files[name] = f
+	}
+
+	read := func(name string, required bool) ([]map[string]string, []int) {
+		rows, lines, err := readGTFSFile(files, name)
+		if err != nil {
+			report.errorf("%s: %s", name, err.Error())
+			return nil, nil
+		}
+		if rows == nil && required {
+			if _, ok := files[name]; !ok {
+				report.errorf("%s: file is missing", name)
+			}
+		}
+		return rows, lines
+	}
+
+	agencies, _ := read("agency.txt", true)
+	routes, routeLines := read("routes.txt", true)
+	stops, stopLines := read("stops.txt", true)
+	trips, tripLines := read("trips.txt", true)
+	stopTimes, stopTimeLines := read("stop_times.txt", true)
+	shapes, shapeLines := read("shapes.txt", false)
+	calendars, calendarLines := read("calendar.txt", false)
+
+	if _, ok := files["calendar_dates.txt"]; ok {
+		report.warnf("calendar_dates.txt: service exceptions are not supported and were ignored")
+	}
+	if _, ok := files["frequencies.txt"]; ok {
+		report.warnf("frequencies.txt: frequency based trips are not supported and were ignored")
+	}
+
+	agencyIDs := make(map[string]bool)
+	for _, a := range agencies {
+		agency := GTFSAgency{ID: a["agency_id"], Name: a["agency_name"], URL: a["agency_url"], Timezone: a["agency_timezone"], Lang: a["agency_lang"], Phone: a["agency_phone"]}
+		if agency.Name == "" || agency.URL == "" || agency.Timezone == "" {
+			report.errorf("agency.txt: agency '%s' must have agency_name, agency_url and agency_timezone", agency.ID)
+		}
+		agencyIDs[agency.ID] = true
+		feed.Agencies = append(feed.Agencies, agency)
+	}
+
+	routeIDs := make(map[string]bool)
+	routeCodes := make(map[string]string)
+	for i, r := range routes {
+		route := GTFSRoute{ID: r["route_id"], AgencyID: r["agency_id"], ShortName: r["route_short_name"], LongName: r["route_long_name"], Color: strings.ToUpper(r["route_color"])}
+		line := routeLines[i]
+
+		if route.ID == "" {
+			report.errorf("routes.txt line %d: route_id is required", line)
+			continue
+		}
+		if routeIDs[route.ID] {
+			report.errorf("routes.txt line %d: route_id '%s' is duplicated", line, route.ID)
+			continue
+		}
+		if len(agencies) > 1 && !agencyIDs[route.AgencyID] {
+			report.errorf("routes.txt line %d: unknown agency_id '%s'", line, route.AgencyID)
+		}
+		if route.ShortName == "" && route.LongName == "" {
+			report.errorf("routes.txt line %d: route_short_name or route_long_name is required", line)
+		}
+		if route.Color == "" {
+			route.Color = "FFFFFF"
+		}
+		if !gtfsColorRegex.MatchString(route.Color) {
+			report.errorf("routes.txt line %d: invalid route_color '%s'", line, route.Color)
+		}
+
+		code := route.ShortName
+		if code == "" {
+			code = route.ID
+		}
+		if len(code) > 20 {
+			report.errorf("routes.txt line %d: route code '%s' is longer than 20 characters", line, code)
+		}
+		if len([]rune(route.LongName)) > 100 {
+			report.errorf("routes.txt line %d: route_long_name is longer than 100 characters", line)
+		}
+		if other, ok := routeCodes[code]; ok {
+			report.errorf("routes.txt line %d: route code '%s' is also used by route_id '%s'", line, code, other)
+		}
+		routeCodes[code] = route.ID
+
+		routeIDs[route.ID] = true
+		feed.Routes = append(feed.Routes, route)
+	}
+
+	stopIDs := make(map[string]bool)
+	for i, s := range stops {
+		line := stopLines[i]
+
+		// Stations, entrances and other nodes cannot be served by a bus
+		if locationType := s["location_type"]; locationType != "" && locationType != "0" {
+			continue
+		}
+
+		stop := GTFSStop{ID: s["stop_id"], Code: s["stop_code"], Name: s["stop_name"], Wheelchair: s["wheelchair_boarding"] == "1"}
+
+		if stop.ID == "" || stop.Name == "" {
+			report.errorf("stops.txt line %d: stop_id and stop_name are required", line)
+			continue
+		}
+		if stopIDs[stop.ID] {
+			report.errorf("stops.txt line %d: stop_id '%s' is duplicated", line, stop.ID)
+			continue
+		}
+
+		lat, errLat := strconv.ParseFloat(s["stop_lat"], 64)
+		lng, errLng := strconv.ParseFloat(s["stop_lon"], 64)
+		if errLat != nil || errLng != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			report.errorf("stops.txt line %d: invalid coordinates for stop_id '%s'", line, stop.ID)
+			continue
+		}
+		stop.Lat, stop.Lng = lat, lng
+
+		stopIDs[stop.ID] = true
+		feed.Stops = append(feed.Stops, stop)
+	}
+
+	serviceIDs := make(map[string]bool)
+	for i, cal := range calendars {
+		line := calendarLines[i]
+		calendar := GTFSCalendar{ServiceID: cal["service_id"]}
+
+		for d, day := range []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"} {
+			calendar.Days[d] = cal[day] == "1"
+		}
+
+		start, errStart := parseGTFSDate(cal["start_date"])
+		end, errEnd := parseGTFSDate(cal["end_date"])
+		if errStart != nil || errEnd != nil {
+			report.errorf("calendar.txt line %d: invalid start_date or end_date for service_id '%s'", line, calendar.ServiceID)
+			continue
+		}
+		calendar.StartDate, calendar.EndDate = start, end
+
+		serviceIDs[calendar.ServiceID] = true
+		feed.Calendars = append(feed.Calendars, calendar)
+	}
+
+	type shapePoint struct {
+		sequence int
+		point    Point
+	}
+
+	shapePoints := make(map[string][]shapePoint)
+	for i, s := range shapes {
+		line := shapeLines[i]
+		lat, errLat := strconv.ParseFloat(s["shape_pt_lat"], 64)
+		lng, errLng := strconv.ParseFloat(s["shape_pt_lon"], 64)
+		seq, errSeq := strconv.Atoi(s["shape_pt_sequence"])
+		if errLat != nil || errLng != nil || errSeq != nil {
+			report.errorf("shapes.txt line %d: invalid point for shape_id '%s'", line, s["shape_id"])
+			continue
+		}
+		shapePoints[s["shape_id"]] = append(shapePoints[s["shape_id"]], shapePoint{sequence: seq, point: Point{Lat: lat, Lng: lng}})
+	}
+
+	// Points must follow shape_pt_sequence, which producers do not always sort
+	for id, points := range shapePoints {
+		sort.SliceStable(points, func(a, b int) bool { return points[a].sequence < points[b].sequence })
+		feed.Shapes[id] = Map(points, func(p shapePoint) Point { return p.point })
+	}
+
+	tripIDs := make(map[string]bool)
+	for i, t := range trips {
+		line := tripLines[i]
+		trip := GTFSTrip{ID: t["trip_id"], RouteID: t["route_id"], ServiceID: t["service_id"], Headsign: t["trip_headsign"], ShapeID: t["shape_id"], Direction: RouteOutbound}
+
+		if t["direction_id"] == "1" {
+			trip.Direction = RouteInbound
+		}
+
+		if trip.ID == "" {
+			report.errorf("trips.txt line %d: trip_id is required", line)
+			continue
+		}
+		if tripIDs[trip.ID] {
+			report.errorf("trips.txt line %d: trip_id '%s' is duplicated", line, trip.ID)
+			continue
+		}
+		if !routeIDs[trip.RouteID] {
+			report.errorf("trips.txt line %d: unknown route_id '%s'", line, trip.RouteID)
+		}
+		if len(calendars) > 0 && !serviceIDs[trip.ServiceID] {
+			report.errorf("trips.txt line %d: unknown service_id '%s'", line, trip.ServiceID)
+		}
+		if trip.ShapeID != "" {
+			if _, ok := feed.Shapes[trip.ShapeID]; !ok {
+				report.errorf("trips.txt line %d: unknown shape_id '%s'", line, trip.ShapeID)
+			}
+		}
+
+		tripIDs[trip.ID] = true
+		feed.Trips = append(feed.Trips, trip)
+	}
+
+	if len(calendars) == 0 && len(trips) > 0 {
+		report.warnf("calendar.txt: file is missing, trips were imported without a service calendar")
+	}
+
+	for i, st := range stopTimes {
+		line := stopTimeLines[i]
+		stopTime := GTFSStopTime{TripID: st["trip_id"], StopID: st["stop_id"]}
+
+		if !tripIDs[stopTime.TripID] {
+			report.errorf("stop_times.txt line %d: unknown trip_id '%s'", line, stopTime.TripID)
+			continue
+		}
+		if !stopIDs[stopTime.StopID] {
+			report.errorf("stop_times.txt line %d: unknown stop_id '%s'", line, stopTime.StopID)
+			continue
+		}
+
+		seq, err := strconv.Atoi(st["stop_sequence"])
+		if err != nil || seq < 0 {
+			report.errorf("stop_times.txt line %d: invalid stop_sequence '%s'", line, st["stop_sequence"])
+			continue
+		}
+		stopTime.Sequence = seq
+
+		// Only timepoints need times, the rest are interpolated by consumers
+		if st["arrival_time"] != "" || st["departure_time"] != "" {
+			arrival, errArrival := parseGTFSTime(strings.TrimSpace(st["arrival_time"]))
+			departure, errDeparture := parseGTFSTime(strings.TrimSpace(st["departure_time"]))
+			if errArrival != nil || errDeparture != nil || departure < arrival {
+				report.errorf("stop_times.txt line %d: invalid arrival_time or departure_time", line)
+				continue
+			}
+			stopTime.Arrival, stopTime.Departure = formatGTFSTime(arrival), formatGTFSTime(departure)
+		}
+
+		feed.StopTimes[stopTime.TripID] = append(feed.StopTimes[stopTime.TripID], stopTime)
+	}
+
+	for _, trip := range feed.Trips {
+		times := feed.StopTimes[trip.ID]
+		sort.Slice(times, func(a, b int) bool { return times[a].Sequence < times[b].Sequence })
+
+		if len(times) < 2 {
+			report.errorf("trips.txt: trip_id '%s' must have at least two stop_times", trip.ID)
+			continue
+		}
+		if times[0].Arrival == "" || times[len(times)-1].Arrival == "" {
+			report.errorf("stop_times.txt: first and last stop of trip_id '%s' must have times", trip.ID)
+		}
+	}
+
+	// Routes without trips have no stops or geometry, saveGTFS skips them
+	routesWithTrips := make(map[string]bool)
+	for _, trip := range feed.Trips {
+		routesWithTrips[trip.RouteID] = true
+	}
+	for _, route := range feed.Routes {
+		if routesWithTrips[route.ID] {
+			report.Routes++
+		} else {
+			report.warnf("routes.txt: route_id '%s' has no trips and was not imported", route.ID)
+		}
+	}
+
+	report.Agencies = len(feed.Agencies)
+	report.Stops = len(feed.Stops)
+	report.Trips = len(feed.Trips)
+	report.Calendars = len(feed.Calendars)
+	for _, times := range feed.StopTimes {
+		report.StopTimes += len(times)
+	}
+
+	return feed, report
+}
+
+// saveGTFS writes a validated feed. Stops and routes are matched by their GTFS
+// ids and code, so importing a new version of the feed updates them in place.
+// The trips and stop times of the imported routes are replaced by the ones in
+// the feed, and calendars are updated by their service id. Trips of routes the
+// feed does not carry are left alone.
+func saveGTFS(feed *GTFSFeed) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, a := range feed.Agencies {
+		if _, err := tx.Exec("INSERT INTO agencies (gtfs_id, name, url, timezone, lang, phone) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (gtfs_id) DO UPDATE SET name = $2, url = $3, timezone = $4, lang = $5, phone = $6", a.ID, a.Name, a.URL, a.Timezone, a.Lang, a.Phone); err != nil {
+			return fmt.Errorf("agency '%s': %w", a.ID, err)
+		}
+	}
+
+	stops := make(map[string]GTFSStop)
+	stopIDs := make(map[string]string)
+	for _, s := range feed.Stops {
+		stops[s.ID] = s
+
+		var id string
+		if err := tx.QueryRow("INSERT INTO stops (id, gtfs_id, code, name, lat, lng, wheelchair, tactile_paving, audio_announcement, active) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, FALSE, FALSE, TRUE) ON CONFLICT (gtfs_id) DO UPDATE SET code = NULLIF($3, ''), name = $4, lat = $5, lng = $6, wheelchair = $7, active = TRUE RETURNING id", uuid.New(), s.ID, s.Code, s.Name, s.Lat, s.Lng, s.Wheelchair).Scan(&id); err != nil {
+			return fmt.Errorf("stop '%s': %w", s.ID, err)
+		}
+		stopIDs[s.ID] = id
+	}
+
+	// Each direction of a GTFS route is a route here. Its stops and geometry
+	// come from the trip with the most stops in that direction.
+	representative := make(map[string]GTFSTrip)
+	for _, t := range feed.Trips {
+		key := t.RouteID + "|" + string(t.Direction)
+		if current, ok := representative[key]; !ok || len(feed.StopTimes[t.ID]) > len(feed.StopTimes[current.ID]) {
+			representative[key] = t
+		}
+	}
+
+	routeIDs := make(map[string]string)
+	for _, r := range feed.Routes {
+		code := r.ShortName
+		if code == "" {
+			code = r.ID
+		}
+		name := r.LongName
+		if name == "" {
+			name = r.ShortName
+		}
+
+		for _, direction := range []RouteDirection{RouteOutbound, RouteInbound} {
+			trip, ok := representative[r.ID+"|"+string(direction)]
+			if !ok {
+				continue
+			}
+
+			times := feed.StopTimes[trip.ID]
+
+			geometry := feed.Shapes[trip.ShapeID]
+			if len(geometry) == 0 {
+				for _, st := range times {
+					geometry = append(geometry, Point{Lat: stops[st.StopID].Lat, Lng: stops[st.StopID].Lng})
+				}
+			}
+
+			routeDirection := direction
+			if times[0].StopID == times[len(times)-1].StopID {
+				routeDirection = RouteCircular
+			}
+
+			geometryJSON, err := json.Marshal(geometry)
+			if err != nil {
+				return err
+			}
+
+			var id string
+			if err := tx.QueryRow("INSERT INTO routes (id, gtfs_id, code, name, direction, color, geometry, agency_gtfs_id, active) VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), TRUE) ON CONFLICT (code, direction) DO UPDATE SET gtfs_id = $2, name = $4, color = $6, geometry = $7, agency_gtfs_id = NULLIF($8, ''), active = TRUE RETURNING id", uuid.New(), r.ID, code, name, routeDirection, "#"+r.Color, string(geometryJSON), r.AgencyID).Scan(&id); err != nil {
+				return fmt.Errorf("route '%s': %w", r.ID, err)
+			}
+			routeIDs[r.ID+"|"+string(direction)] = id
+
+			if _, err := tx.Exec("UPDATE bus SET route = $1 WHERE id_route = $2", code, id); err != nil {
+				return fmt.Errorf("route '%s': %w", r.ID, err)
+			}
+
+			if _, err := tx.Exec("DELETE FROM route_stops WHERE id_route = $1", id); err != nil {
+				return fmt.Errorf("route '%s': %w", r.ID, err)
+			}
+			for i, st := range times {
+				if _, err := tx.Exec("INSERT INTO route_stops (id_route, id_stop, sequence) VALUES ($1, $2, $3)", id, stopIDs[st.StopID], i+1); err != nil {
+					return fmt.Errorf("route '%s': %w", r.ID, err)
+				}
+			}
+		}
+	}
+
+	importedRoutes := make([]string, 0, len(routeIDs))
+	for _, id := range routeIDs {
+		importedRoutes = append(importedRoutes, id)
+	}
+	tripIDs := make([]string, 0, len(feed.Trips))
+	for _, t := range feed.Trips {
+		tripIDs = append(tripIDs, t.ID)
+	}
+
+	// Trip ids are unique across routes, so a trip moved to another route in
+	// the feed is replaced as well
+	if _, err := tx.Exec("DELETE FROM trip_stop_times WHERE id_trip IN (SELECT id FROM trips WHERE id_route = ANY($1::uuid[]) OR id = ANY($2))", pq.Array(importedRoutes), pq.Array(tripIDs)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM trips WHERE id_route = ANY($1::uuid[]) OR id = ANY($2)", pq.Array(importedRoutes), pq.Array(tripIDs)); err != nil {
+		return err
+	}
+
+	// Upserting keeps the holidays flag, which GTFS calendars do not carry
+	for _, cal := range feed.Calendars {
+		d := cal.Days
+		if _, err := tx.Exec("INSERT INTO service_calendars (id, monday, tuesday, wednesday, thursday, friday, saturday, sunday, start_date, end_date) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (id) DO UPDATE SET monday = $2, tuesday = $3, wednesday = $4, thursday = $5, friday = $6, saturday = $7, sunday = $8, start_date = $9, end_date = $10", cal.ServiceID, d[0], d[1], d[2], d[3], d[4], d[5], d[6], cal.StartDate, cal.EndDate); err != nil {
+			return fmt.Errorf("calendar '%s': %w", cal.ServiceID, err)
+		}
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO trip_stop_times (id_trip, id_stop, sequence, arrival_time, departure_time) VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, t := range feed.Trips {
+		if _, err := tx.Exec("INSERT INTO trips (id, id_route, id_service, headsign, shape_id) VALUES ($1, $2, NULLIF($3, ''), $4, $5)", t.ID, routeIDs[t.RouteID+"|"+string(t.Direction)], t.ServiceID, t.Headsign, t.ShapeID); err != nil {
+			return fmt.Errorf("trip '%s': %w", t.ID, err)
+		}
+
+		for _, st := range feed.StopTimes[t.ID] {
+			if _, err := stmt.Exec(t.ID, stopIDs[st.StopID], st.Sequence, st.Arrival, st.Departure); err != nil {
+				return fmt.Errorf("trip '%s': %w", t.ID, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func importGTFS(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Field 'file' is required"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot read uploaded file"})
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot read uploaded file"})
+		return
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid GTFS file, it must be a zip archive", "errors": err.Error()})
+		return
+	}
+
+	feed, report := parseGTFS(zr)
+
+	if len(report.Errors) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid GTFS feed", "report": report})
+		return
+	}
+
+	if err := saveGTFS(feed); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot import GTFS feed", "errors": err.Error()})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "GTFS feed successfully imported!", "report": report})
+}
+
+// GTFSCache keeps the last generated static feed so third-party apps polling
+// it do not rebuild the zip on every request.
+type GTFSCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	data    []byte
+	etag    string
+	builtAt time.Time
+}
+
+func NewGTFSCache(ttl time.Duration) *GTFSCache {
+	return &GTFSCache{ttl: ttl}
+}
+
+// Get returns the cached feed, building it again when it is missing or older
+// than the cache TTL.
+func (g *GTFSCache) Get() ([]byte, string, time.Time, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.data != nil && time.Since(g.builtAt) < g.ttl {
+		return g.data, g.etag, g.builtAt, nil
+	}
+
+	data, err := buildGTFS()
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	g.data = data
+	g.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	g.builtAt = time.Now()
+
+	return g.data, g.etag, g.builtAt, nil
+}
+
+// Invalidate drops the cached feed after routes, stops or schedules change.
+func (g *GTFSCache) Invalidate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.data = nil
+}
+
+func writeGTFSFile(zw *zip.Writer, name string, header []string, rows [][]string) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+
+	return w.Error()
+}
+
+// queryGTFSRows runs a query whose columns are all text and returns its rows.
+func queryGTFSRows(query string, args ...any) ([][]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var result [][]string
+	for rows.Next() {
+		record := make([]string, len(columns))
+		dest := make([]any, len(columns))
+		for i := range record {
+			dest[i] = &record[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+
+	return result, rows.Err()
+}
+
+// buildGTFS generates the static feed. Both directions of a route code are one
+// GTFS route, and each route direction exports its geometry as a shape.
+func buildGTFS() ([]byte, error) {
+	agencies, err := queryGTFSRows("SELECT COALESCE(gtfs_id, ''), name, url, timezone, COALESCE(lang, ''), COALESCE(phone, '') FROM agencies ORDER BY gtfs_id")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(agencies) == 0 {
+		timezone := viper.GetString("GTFS_AGENCY_TIMEZONE")
+		if timezone == "" {
+			timezone = "America/Sao_Paulo"
+		}
+		agencies = [][]string{{"1", viper.GetString("GTFS_AGENCY_NAME"), viper.GetString("GTFS_AGENCY_URL"), timezone, "pt", ""}}
+	}
+
+	// Every route names its agency, so the agencies need an ID even when the
+	// imported feed had a single one without it
+	agencyIDs := make(map[string]bool)
+	for i, a := range agencies {
+		if a[0] == "" {
+			a[0] = strconv.Itoa(i + 1)
+		}
+		if a[1] == "" || a[2] == "" {
+			return nil, fmt.Errorf("agency '%s' must have a name and a url, set GTFS_AGENCY_NAME and GTFS_AGENCY_URL or import an agency.txt", a[0])
+		}
+		agencyIDs[a[0]] = true
+	}
+
+	routes, err := queryGTFSRows("SELECT DISTINCT ON (code) code, COALESCE(agency_gtfs_id, ''), code, name, '3', TRIM(LEADING '#' FROM color) FROM routes WHERE active IS TRUE ORDER BY code, direction DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	// Routes created in the admin belong to the first agency
+	for _, r := range routes {
+		if !agencyIDs[r[1]] {
+			r[1] = agencies[0][0]
+		}
+	}
+
+	stops, err := queryGTFSRows("SELECT COALESCE(gtfs_id, id::text), COALESCE(code, ''), name, lat::text, lng::text, CASE WHEN wheelchair THEN '1' ELSE '0' END FROM stops WHERE active IS TRUE ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	calendars, err := queryGTFSRows("SELECT id, CASE WHEN monday THEN '1' ELSE '0' END, CASE WHEN tuesday THEN '1' ELSE '0' END, CASE WHEN wednesday THEN '1' ELSE '0' END, CASE WHEN thursday THEN '1' ELSE '0' END, CASE WHEN friday THEN '1' ELSE '0' END, CASE WHEN saturday THEN '1' ELSE '0' END, CASE WHEN sunday THEN '1' ELSE '0' END, REPLACE(start_date, '-', ''), REPLACE(end_date, '-', '') FROM service_calendars ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	// Holidays become exceptions of the services that run, or do not run, on
+	// them against their day of the week
+	calendarDates, err := queryGTFSRows("SELECT sc.id, REPLACE(h.date, '-', ''), CASE WHEN sc.holidays THEN '1' ELSE '2' END FROM service_calendars sc JOIN holidays h ON h.date BETWEEN sc.start_date AND sc.end_date WHERE sc.holidays <> (ARRAY[sc.monday, sc.tuesday, sc.wednesday, sc.thursday, sc.friday, sc.saturday, sc.sunday])[EXTRACT(ISODOW FROM h.date::date)::int] ORDER BY sc.id, h.date")
+	if err != nil {
+		return nil, err
+	}
+
+	// Trips without a service calendar have no days to run on and are left out
+	trips, err := queryGTFSRows("SELECT r.code, t.id_service, t.id, COALESCE(t.headsign, ''), CASE WHEN r.direction = 'INBOUND' THEN '1' ELSE '0' END, CASE WHEN jsonb_array_length(r.geometry) > 1 THEN r.id::text ELSE '' END FROM trips t JOIN routes r ON r.id = t.id_route JOIN service_calendars sc ON sc.id = t.id_service WHERE r.active IS TRUE ORDER BY r.code, t.id")
+	if err != nil {
+		return nil, err
+	}
+
+	stopTimes, err := queryGTFSRows("SELECT st.id_trip, COALESCE(st.arrival_time, ''), COALESCE(st.departure_time, ''), COALESCE(s.gtfs_id, s.id::text), st.sequence::text FROM trip_stop_times st JOIN trips t ON t.id = st.id_trip JOIN service_calendars sc ON sc.id = t.id_service JOIN routes r ON r.id = t.id_route JOIN stops s ON s.id = st.id_stop WHERE r.active IS TRUE AND s.active IS TRUE ORDER BY st.id_trip, st.sequence")
+	if err != nil {
+		return nil, err
+	}
+
+	shapeRows, err := queryGTFSRows("SELECT id::text, geometry::text FROM routes WHERE active IS TRUE AND jsonb_array_length(geometry) > 1 ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	var shapes [][]string
+	for _, row := range shapeRows {
+		var points []Point
+		if err := json.Unmarshal([]byte(row[1]), &points); err != nil {
+			return nil, err
+		}
+		for i, p := range points {
+			shapes = append(shapes, []string{row[0], strconv.FormatFloat(p.Lat, 'f', 6, 64), strconv.FormatFloat(p.Lng, 'f', 6, 64), strconv.Itoa(i + 1)})
+		}
+	}
+
+	fares, err := queryGTFSRows("SELECT DISTINCT ON (code) code, to_char(fare, 'FM999990.00') FROM routes WHERE active IS TRUE AND fare IS NOT NULL ORDER BY code, direction DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	var fareAttributes, fareRules [][]string
+	for _, f := range fares {
+		fareAttributes = append(fareAttributes, []string{"F" + f[0], f[1], "BRL", "0", "0"})
+		fareRules = append(fareRules, []string{"F" + f[0], f[0]})
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	files := []struct {
+		name   string
+		header []string
+		rows   [][]string
+	}{
+		{"agency.txt", []string{"agency_id", "agency_name", "agency_url", "agency_timezone", "agency_lang", "agency_phone"}, agencies},
+		{"routes.txt", []string{"route_id", "agency_id", "route_short_name", "route_long_name", "route_type", "route_color"}, routes},
+		{"stops.txt", []string{"stop_id", "stop_code", "stop_name", "stop_lat", "stop_lon", "wheelchair_boarding"}, stops},
+		{"calendar.txt", []string{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"}, calendars},
+		{"calendar_dates.txt", []string{"service_id", "date", "exception_type"}, calendarDates},
+		{"trips.txt", []string{"route_id", "service_id", "trip_id", "trip_headsign", "direction_id", "shape_id"}, trips},
+		{"stop_times.txt", []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence"}, stopTimes},
+		{"shapes.txt", []string{"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence"}, shapes},
+		{"fare_attributes.txt", []string{"fare_id", "price", "currency_type", "payment_method", "transfers"}, fareAttributes},
+		{"fare_rules.txt", []string{"fare_id", "route_id"}, fareRules},
+	}
+
+	for _, f := range files {
+		// Optional files are left out instead of being shipped empty
+		if len(f.rows) == 0 && (f.name == "calendar_dates.txt" || f.name == "shapes.txt" || f.name == "fare_attributes.txt" || f.name == "fare_rules.txt") {
+			continue
+		}
+		if err := writeGTFSFile(zw, f.name, f.header, f.rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func getGTFSFeed(c *gin.Context) {
+	data, etag, builtAt, err := gtfsCache.Get()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot generate GTFS feed"})
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", builtAt.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(gtfsCache.ttl.Seconds())))
+
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="gtfs.zip"`)
+	c.Data(http.StatusOK, "application/zip", data)
+}
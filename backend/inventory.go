@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/lib/pq"
+)
+
+type InventoryStatus string
+
+const (
+	InventoryPrinted   InventoryStatus = "PRINTED"
+	InventoryShipped   InventoryStatus = "SHIPPED"
+	InventorySold      InventoryStatus = "SOLD"
+	InventoryActivated InventoryStatus = "ACTIVATED"
+)
+
+type InventoryCard struct {
+	Uid      string          `json:"uid"`
+	Serial   string          `json:"serial"`
+	Batch    string          `json:"batch"`
+	Status   InventoryStatus `json:"status"`
+	IdUser   string          `json:"id_user,omitempty"`
+	IssuedAt string          `json:"issued_at,omitempty"`
+	Date     string          `json:"date"`
+}
+
+type InventoryStatusUpdate struct {
+	Status InventoryStatus `json:"status" binding:"required,oneof=PRINTED SHIPPED SOLD"`
+}
+
+type InventoryIssue struct {
+	IdUser string `json:"id_user" binding:"required,uuid"`
+}
+
+// activateInventoryCard marks a stock card as activated once it is linked to a
+// user. Cards that were never imported into the inventory are ignored.
+func activateInventoryCard(q dbExecutor, uid string, IdUser string) error {
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	_, err := q.Exec("UPDATE card_inventory SET status = $1, id_user = $2, issued_at = $3 WHERE uid = $4", InventoryActivated, IdUser, createDateString(time), uid)
+	return err
+}
+
+func getInventory(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	batch := c.Query("batch")
+	status := strings.ToUpper(c.Query("status"))
+
+	rows, err := db.Query("SELECT uid, serial, batch, status, COALESCE(id_user::text, ''), COALESCE(issued_at, ''), date FROM card_inventory WHERE ($1 = '' OR batch = $1) AND ($2 = '' OR status = $2) ORDER BY batch, serial", batch, status)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var cards []InventoryCard
+	for rows.Next() {
+		var i InventoryCard
+		err := rows.Scan(&i.Uid, &i.Serial, &i.Batch, &i.Status, &i.IdUser, &i.IssuedAt, &i.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		cards = append(cards, i)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, cards)
+}
+
+func getInventorySummary(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT batch, status, COUNT(*) FROM card_inventory GROUP BY batch, status ORDER BY batch, status")
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	summary := make(map[string]map[InventoryStatus]int)
+	for rows.Next() {
+		var batch string
+		var status InventoryStatus
+		var count int
+		if err := rows.Scan(&batch, &status, &count); err != nil {
+			log.Println(err)
+			continue
+		}
+		if summary[batch] == nil {
+			summary[batch] = make(map[InventoryStatus]int)
+		}
+		summary[batch][status] = count
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, summary)
+}
+
+// importInventoryCSV loads a batch of printed cards. Each line holds batch,
+// serial and UID. Nothing is imported unless every line is valid.
+func importInventoryCSV(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Field 'file' is required"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot read uploaded file"})
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot read uploaded file"})
+		return
+	}
+
+	reader := csv.NewReader(bytes.NewReader(content))
+	firstLine, _, _ := strings.Cut(string(content), "\n")
+	if strings.Contains(firstLine, ";") {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid CSV file", "errors": err.Error()})
+		return
+	}
+
+	if len(records) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "batch") {
+		records = records[1:]
+	}
+
+	if len(records) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "CSV file has no cards"})
+		return
+	}
+
+	var errorMessages []string
+	cards := make([]InventoryCard, 0, len(records))
+	uids := make([]string, 0, len(records))
+	serials := make([]string, 0, len(records))
+	lines := make(map[string]int)
+
+	for i, record := range records {
+		line := i + 1
+		batch := strings.TrimSpace(record[0])
+		serial := strings.TrimSpace(record[1])
+
+		if batch == "" || serial == "" {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: batch and serial are required", line))
+			continue
+		}
+
+		uid, err := normalizeUID(record[2])
+		if err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: invalid UID '%s': %s", line, record[2], err.Error()))
+			continue
+		}
+
+		if prev, ok := lines["uid|"+uid]; ok {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: UID '%s' is duplicated from line %d", line, uid, prev))
+			continue
+		}
+		if prev, ok := lines["serial|"+serial]; ok {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: serial '%s' is duplicated from line %d", line, serial, prev))
+			continue
+		}
+
+		lines["uid|"+uid] = line
+		lines["serial|"+serial] = line
+		uids = append(uids, uid)
+		serials = append(serials, serial)
+		cards = append(cards, InventoryCard{Uid: uid, Serial: serial, Batch: batch, Status: InventoryPrinted})
+	}
+
+	rows, err := db.Query("SELECT uid, serial FROM card_inventory WHERE uid = ANY($1) OR serial = ANY($2)", pq.Array(uids), pq.Array(serials))
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot import cards"})
+		return
+	}
+	for rows.Next() {
+		var uid, serial string
+		if err := rows.Scan(&uid, &serial); err != nil {
+			log.Println(err)
+			continue
+		}
+		if line, ok := lines["uid|"+uid]; ok {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: UID '%s' is already in the inventory", line, uid))
+		}
+		if line, ok := lines["serial|"+serial]; ok {
+			errorMessages = append(errorMessages, fmt.Sprintf("Line %d: serial '%s' is already in the inventory", line, serial))
+		}
+	}
+	rows.Close()
+
+	if len(errorMessages) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid cards", "errors": errorMessages})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot import cards"})
+		return
+	}
+	defer tx.Rollback()
+
+	for _, card := range cards {
+		if _, err := tx.Exec("INSERT INTO card_inventory (uid, serial, batch, status, date) VALUES ($1, $2, $3, $4, $5)", card.Uid, card.Serial, card.Batch, card.Status, createDateString(time)); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot import cards", "errors": []string{fmt.Sprintf("Serial '%s': cannot be imported", card.Serial)}})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot import cards"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Cards successfully imported!", "imported": len(cards)})
+}
+
+func updateInventoryStatus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var update InventoryStatusUpdate
+
+	if err := c.ShouldBindJSON(&update); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	// Activated cards only leave that status through the card-linking API
+	result, err := db.Exec("UPDATE card_inventory SET status = $1 WHERE uid = $2 AND status <> $3", update.Status, uid, InventoryActivated)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update card with UID: " + uid})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No stock card found with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Card status successfully updated!", "uid": uid, "status": update.Status})
+}
+
+// issueInventoryCard hands a stock card to a user, linking it to the account
+// the same way riders link their own cards.
+func issueInventoryCard(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var issue InventoryIssue
+
+	if err := c.ShouldBindJSON(&issue); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	uid, err := normalizeUID(c.Param("uid"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + c.Param("uid"), "errors": err.Error()})
+		return
+	}
+
+	var card InventoryCard
+	row := db.QueryRow("SELECT uid, serial, batch, status FROM card_inventory WHERE uid = $1", uid)
+
+	err_card := row.Scan(&card.Uid, &card.Serial, &card.Batch, &card.Status)
+
+	if err_card != nil {
+		if err_card == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No stock card found with UID: " + uid})
+			return
+		} else {
+			log.Println(err_card)
+		}
+	}
+
+	if card.Status == InventoryActivated {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Card already issued with UID: " + uid})
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", issue.IdUser).Scan(&exists); err != nil {
+		log.Println(err)
+	}
+
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + issue.IdUser})
+		return
+	}
+
+	if err := linkCardUser(uid, issue.IdUser, false); err != nil {
+		if err == ErrCardLinked {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Card already linked with UID: " + uid})
+			return
+		}
+		if err == ErrCardAnonymous {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Card is anonymous, it must be claimed with UID: " + uid})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot link card with UID: " + uid})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Card successfully issued!", "uid": uid, "serial": card.Serial, "id_user": issue.IdUser})
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type JourneyStatus string
+
+const (
+	JourneyOpen       JourneyStatus = "OPEN"
+	JourneyClosed     JourneyStatus = "CLOSED"
+	JourneyAutoClosed JourneyStatus = "AUTO_CLOSED"
+)
+
+// Journey is a ride on a tap-out route. The maximum fare is charged when the
+// card taps in and the difference to the real fare is refunded on tap-out.
+// Journeys without a tap-out keep the maximum fare.
+type Journey struct {
+	ID         string        `json:"id"`
+	IdFare     string        `json:"id_fare"`
+	Uid        string        `json:"uid"`
+	IdUser     string        `json:"id_user,omitempty"`
+	IdBus      string        `json:"id_bus"`
+	Bus        string        `json:"bus,omitempty"`
+	IdRoute    string        `json:"id_route"`
+	IdZoneFrom string        `json:"id_zone_from,omitempty"`
+	IdZoneTo   string        `json:"id_zone_to,omitempty"`
+	MaxFare    float64       `json:"max_fare"`
+	Fare       float64       `json:"fare"`
+	Status     JourneyStatus `json:"status"`
+	StartedAt  string        `json:"started_at"`
+	EndedAt    string        `json:"ended_at,omitempty"`
+	Debits     []WalletDebit `json:"-"`
+}
+
+// openJourney starts a journey for a fare just charged on a tap-out route.
+// debits are the wallet debits of the fare, refunds go back to them.
+func openJourney(q dbExecutor, bus Bus, card Uid, IdUser string, IdFare string, charge float64, debits []WalletDebit) error {
+	if !bus.TapOut || card.Uid == "" {
+		return nil
+	}
+
+	if debits == nil {
+		debits = []WalletDebit{}
+	}
+
+	debitsJSON, err := json.Marshal(debits)
+	if err != nil {
+		return err
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	_, err = q.Exec("INSERT INTO journeys (id, id_fare, uid, id_user, id_bus, id_route, id_zone_from, max_fare, debits, status, started_at) VALUES ($1, $2, $3, NULLIF($4, '')::uuid, $5, $6, NULLIF($7, '')::uuid, $8, $9, $10, $11)", uuid.New(), IdFare, card.Uid, IdUser, bus.ID, bus.IdRoute, bus.IdZone, charge, string(debitsJSON), JourneyOpen, createDateString(time))
+	return err
+}
+
+func getOpenJourney(uid string) (Journey, error) {
+	var journey Journey
+	var debits []byte
+
+	row := db.QueryRow("SELECT id, id_fare, uid, COALESCE(id_user::text, ''), id_bus, id_route, COALESCE(id_zone_from::text, ''), max_fare, debits, status, started_at FROM journeys WHERE uid = $1 AND status = $2 ORDER BY started_at::timestamptz DESC LIMIT 1", uid, JourneyOpen)
+
+	if err := row.Scan(&journey.ID, &journey.IdFare, &journey.Uid, &journey.IdUser, &journey.IdBus, &journey.IdRoute, &journey.IdZoneFrom, &journey.MaxFare, &debits, &journey.Status, &journey.StartedAt); err != nil {
+		return journey, err
+	}
+
+	if len(debits) > 0 {
+		if err := json.Unmarshal(debits, &journey.Debits); err != nil {
+			return journey, err
+		}
+	}
+
+	return journey, nil
+}
+
+// autoCloseJourney ends a journey without tap-out, it keeps the maximum fare.
+func autoCloseJourney(IdJourney string) error {
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var IdUser, IdFare string
+	var maxFare float64
+	row := tx.QueryRow("UPDATE journeys SET status = $1, fare = max_fare, ended_at = $2 WHERE id = $3 AND status = $4 RETURNING COALESCE(id_user::text, ''), id_fare, max_fare", JourneyAutoClosed, createDateString(time), IdJourney, JourneyOpen)
+
+	if err := row.Scan(&IdUser, &IdFare, &maxFare); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	if IdUser != "" {
+		if _, err := accrueLoyaltyPointsTx(tx, IdUser, IdFare, maxFare); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// closeExpiredJourneys auto-closes the journeys open for longer than maxAge.
+func closeExpiredJourneys(maxAge time.Duration) (int64, error) {
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("UPDATE journeys SET status = $1, fare = max_fare, ended_at = $2 WHERE status = $3 AND started_at::timestamptz < $4 RETURNING COALESCE(id_user::text, ''), id_fare, max_fare", JourneyAutoClosed, createDateString(time), JourneyOpen, time.Add(-maxAge))
+	if err != nil {
+		return 0, err
+	}
+
+	var closed []Journey
+	for rows.Next() {
+		var j Journey
+		if err := rows.Scan(&j.IdUser, &j.IdFare, &j.MaxFare); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		closed = append(closed, j)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, j := range closed {
+		if j.IdUser == "" {
+			continue
+		}
+		if _, err := accrueLoyaltyPointsTx(tx, j.IdUser, j.IdFare, j.MaxFare); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return int64(len(closed)), nil
+}
+
+func runJourneyAutoClose(maxAge time.Duration, interval time.Duration) {
+	for range time.Tick(interval) {
+		closed, err := closeExpiredJourneys(maxAge)
+		if err != nil {
+			log.Println(err)
+		} else if closed > 0 {
+			log.Printf("%d journeys auto-closed without tap-out", closed)
+		}
+	}
+}
+
+// isTapOut reports whether a tap of a card with an open journey ends it. Only
+// a tap on the same bus, still running the tap-out route the journey started
+// on and inside the time a ride can take, is a tap-out. Any other tap starts a
+// new ride and the journey keeps its maximum fare.
+func isTapOut(bus Bus, journey Journey) bool {
+	if !bus.TapOut || journey.IdBus != bus.ID || journey.IdRoute != bus.IdRoute {
+		return false
+	}
+
+	startedAt, err := parseDateString(journey.StartedAt)
+	if err != nil {
+		return false
+	}
+
+	return time.Since(startedAt) <= journeyTapOutWindow
+}
+
+// isRideTooShort reports whether a tap-out comes so soon after boarding, and
+// still in the boarding zone, that it is a repeated tap or a card held on the
+// reader rather than the end of the ride.
+func isRideTooShort(bus Bus, journey Journey) bool {
+	startedAt, err := parseDateString(journey.StartedAt)
+	if err != nil {
+		return false
+	}
+
+	zoneChanged := bus.IdZone != "" && journey.IdZoneFrom != "" && bus.IdZone != journey.IdZoneFrom
+
+	return time.Since(startedAt) < journeyMinRide && !zoneChanged
+}
+
+// refundJourney gives the difference back to the wallets the fare was taken
+// from, the last debited first, or to the card when it is anonymous.
+func refundJourney(tx *sql.Tx, journey Journey, refund float64) error {
+	if journey.IdUser == "" {
+		var balance float64
+		row := tx.QueryRow("UPDATE uids SET balance = balance + $1 WHERE uid = $2 RETURNING balance", refund, journey.Uid)
+
+		if err := row.Scan(&balance); err != nil {
+			return err
+		}
+
+		return insertCardBalanceHistoryTx(tx, journey.Uid, (balance - refund), balance, refund, FareRefund)
+	}
+
+	remaining := refund
+	for i := len(journey.Debits) - 1; i >= 0 && remaining > 0.000001; i-- {
+		value := min(journey.Debits[i].Value, remaining)
+
+		if _, err := creditWalletUserTx(tx, journey.IdUser, journey.Debits[i].Type, value, FareRefund); err != nil {
+			return err
+		}
+		remaining -= value
+	}
+
+	return nil
+}
+
+// settleJourney closes the journey on tap-out. The real fare comes from the
+// zone fare matrix of the route, between the boarding zone and the zone the
+// bus is in now; without both zones the maximum fare stays. The journey is
+// only closed if the refund goes through.
+func settleJourney(c *gin.Context, bus Bus, journey Journey) {
+	fare := journey.MaxFare
+
+	var IdZoneTo string
+	if journey.IdZoneFrom != "" {
+		zone, err := getBusZone(bus.ID)
+		if err == nil {
+			IdZoneTo = zone.ID
+			if zoneFare, err := getZoneFare(journey.IdRoute, journey.IdZoneFrom, zone.ID); err == nil {
+				fare = math.Min(zoneFare, journey.MaxFare)
+			} else if err != sql.ErrNoRows {
+				log.Println(err)
+			}
+		} else if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TAP_OUT_FAILED", "message": "Não foi possível encerrar a viagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot close journey with ID: " + journey.ID})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE journeys SET status = $1, id_zone_to = NULLIF($2, '')::uuid, fare = $3, ended_at = $4 WHERE id = $5 AND status = $6", JourneyClosed, IdZoneTo, fare, createDateString(time), journey.ID, JourneyOpen)
+	if err != nil {
+		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TAP_OUT_FAILED", "message": "Não foi possível encerrar a viagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot close journey with ID: " + journey.ID})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "ALREADY_VALIDATED", "message": "Viagem já encerrada"}})
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Journey already closed, ID: " + journey.ID})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE fares SET fare = $1 WHERE id = $2", fare, journey.IdFare); err != nil {
+		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TAP_OUT_FAILED", "message": "Não foi possível encerrar a viagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot close journey with ID: " + journey.ID})
+		return
+	}
+
+	refund := journey.MaxFare - fare
+
+	if refund > 0 {
+		if err := refundJourney(tx, journey, refund); err != nil {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TAP_OUT_FAILED", "message": "Não foi possível encerrar a viagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot close journey with ID: " + journey.ID})
+			return
+		}
+	}
+
+	// Points are earned on the fare the ride settled at
+	var points int
+	if journey.IdUser != "" {
+		points, err = accrueLoyaltyPointsTx(tx, journey.IdUser, journey.IdFare, fare)
+		if err != nil {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TAP_OUT_FAILED", "message": "Não foi possível encerrar a viagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot close journey with ID: " + journey.ID})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TAP_OUT_FAILED", "message": "Não foi possível encerrar a viagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot close journey with ID: " + journey.ID})
+		return
+	}
+
+	var balance float64
+	if journey.IdUser != "" {
+		balance, err = getBalanceUser(journey.IdUser)
+		if err != nil {
+			log.Println(err)
+		}
+	} else if err := db.QueryRow("SELECT balance FROM uids WHERE uid = $1", journey.Uid).Scan(&balance); err != nil {
+		log.Println(err)
+	}
+
+	var user User
+	if journey.IdUser != "" {
+		row_user := db.QueryRow("SELECT id, image, name, surname FROM users WHERE id = $1", journey.IdUser)
+
+		if err := row_user.Scan(&user.ID, &user.Image, &user.Name, &user.Surname); err != nil {
+			log.Println(err)
+		}
+	} else {
+		user.Name = "Cartão avulso"
+	}
+
+	hub.BroadcastToID(bus.ID, gin.H{"type": "success", "tap_out": true, "id": user.ID, "image": user.Image, "name": user.Name, "surname": user.Surname, "fare": fare, "max_fare": journey.MaxFare, "refund": refund, "balance": balance, "points": points, "message": "Viagem encerrada, boa viagem!"})
+	c.IndentedJSON(http.StatusOK, gin.H{"tap_out": true, "id": journey.ID, "uid": journey.Uid, "fare": fare, "max_fare": journey.MaxFare, "refund": refund, "balance": balance, "points": points})
+}
+
+func getJourneysByUser(c *gin.Context) {
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	rows, err := db.Query("SELECT j.id, j.id_fare, j.uid, j.id_bus, b.name, j.id_route, COALESCE(j.id_zone_from::text, ''), COALESCE(j.id_zone_to::text, ''), j.max_fare, COALESCE(j.fare, j.max_fare), j.status, j.started_at, COALESCE(j.ended_at, '') FROM journeys j JOIN bus b ON b.id = j.id_bus WHERE j.id_user = $1 ORDER BY j.started_at::timestamptz DESC", IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var journeys []Journey
+	for rows.Next() {
+		var j Journey
+		err := rows.Scan(&j.ID, &j.IdFare, &j.Uid, &j.IdBus, &j.Bus, &j.IdRoute, &j.IdZoneFrom, &j.IdZoneTo, &j.MaxFare, &j.Fare, &j.Status, &j.StartedAt, &j.EndedAt)
+		if err != nil {
+			log.Println(err)
+		}
+		journeys = append(journeys, j)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, journeys)
+}
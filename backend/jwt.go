@@ -71,3 +71,59 @@ func getUserIDFromToken(tokenString string) (string, error) {
 
 	return "", fmt.Errorf("id_user not found in token claims")
 }
+
+func getRoleFromToken(tokenString string) (string, error) {
+	claims, err := getTokenClaims(tokenString)
+	if err != nil {
+		return "", err
+	}
+
+	if role, ok := claims["role_user"].(string); ok {
+		return role, nil
+	}
+
+	return "", fmt.Errorf("role_user not found in token claims")
+}
+
+// QR tickets are signed with a key derived from JwtSecret so they can never be
+// used as a login token, nor a login token as a ticket.
+func qrTicketSecret() []byte {
+	return append([]byte("qr-ticket:"), JwtSecret...)
+}
+
+func createQRTicketToken(IdUser string, jti string, expiresAt time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
+		jwt.MapClaims{
+			"id_user": IdUser,
+			"jti":     jti,
+			"exp":     expiresAt.Unix(),
+		})
+
+	return token.SignedString(qrTicketSecret())
+}
+
+func getQRTicketClaims(tokenString string) (string, string, error) {
+	token, err := jwt.ParseWithClaims(tokenString, jwt.MapClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return qrTicketSecret(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", "", err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", "", fmt.Errorf("invalid claims type")
+	}
+
+	id, ok := claims["id_user"].(string)
+	if !ok {
+		return "", "", fmt.Errorf("id_user not found in token claims")
+	}
+
+	jti, ok := claims["jti"].(string)
+	if !ok {
+		return "", "", fmt.Errorf("jti not found in token claims")
+	}
+
+	return id, jti, nil
+}
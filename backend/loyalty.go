@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+type LoyaltySettings struct {
+	PointsPerReal float64 `json:"points_per_real" binding:"gte=0"`
+	RedeemPoints  int     `json:"redeem_points" binding:"required,gt=0"`
+	RedeemValue   float64 `json:"redeem_value" binding:"required,gt=0"`
+	ExpiryDays    int     `json:"expiry_days" binding:"gte=0"`
+}
+
+type LoyaltyPoints struct {
+	ID        string `json:"id"`
+	IdFare    string `json:"id_fare,omitempty"`
+	Points    int    `json:"points"`
+	Remaining int    `json:"remaining"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Date      string `json:"date"`
+}
+
+type LoyaltyRedeem struct {
+	Points int `json:"points" binding:"required,gt=0"`
+}
+
+var defaultLoyaltySettings = LoyaltySettings{PointsPerReal: 1, RedeemPoints: 100, RedeemValue: 1, ExpiryDays: 365}
+
+func getLoyaltySettingsDB() (LoyaltySettings, error) {
+	var settings LoyaltySettings
+	row := db.QueryRow("SELECT points_per_real, redeem_points, redeem_value, expiry_days FROM loyalty_settings WHERE id = 1")
+
+	if err := row.Scan(&settings.PointsPerReal, &settings.RedeemPoints, &settings.RedeemValue, &settings.ExpiryDays); err != nil {
+		if err == sql.ErrNoRows {
+			return defaultLoyaltySettings, nil
+		}
+		return defaultLoyaltySettings, err
+	}
+
+	return settings, nil
+}
+
+// getLoyaltyPointsUser returns the points that can still be redeemed, ignoring
+// the ones already expired.
+func getLoyaltyPointsUser(IdUser string) (int, error) {
+	var points int
+	row := db.QueryRow("SELECT COALESCE(SUM(remaining), 0) FROM loyalty_points WHERE id_user = $1 AND remaining > 0 AND COALESCE(NULLIF(expires_at, '')::timestamptz > now(), TRUE)", IdUser)
+
+	err := row.Scan(&points)
+	return points, err
+}
+
+// accrueLoyaltyPoints rewards a paid fare. Rides covered by a pass do not earn points.
+func accrueLoyaltyPoints(IdUser string, IdFare string, fare float64) (int, error) {
+	return accrueLoyaltyPointsTx(db, IdUser, IdFare, fare)
+}
+
+func accrueLoyaltyPointsTx(q dbExecutor, IdUser string, IdFare string, fare float64) (int, error) {
+	settings, err := getLoyaltySettingsDB()
+	if err != nil {
+		return 0, err
+	}
+
+	points := int(math.Floor(fare * settings.PointsPerReal))
+	if points <= 0 {
+		return 0, nil
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	expiresAt := ""
+	if settings.ExpiryDays > 0 {
+		expiresAt = createDateString(time.AddDate(0, 0, settings.ExpiryDays))
+	}
+
+	if _, err := q.Exec("INSERT INTO loyalty_points (id, id_user, id_fare, points, remaining, expires_at, date) VALUES ($1, $2, $3, $4, $4, $5, $6)", uuid.New(), IdUser, IdFare, points, expiresAt, createDateString(time)); err != nil {
+		return 0, err
+	}
+
+	return points, nil
+}
+
+func getLoyaltySettings(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	settings, err := getLoyaltySettingsDB()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, settings)
+}
+
+func updateLoyaltySettings(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var settings LoyaltySettings
+
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if _, err := db.Exec("INSERT INTO loyalty_settings (id, points_per_real, redeem_points, redeem_value, expiry_days) VALUES (1, $1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET points_per_real = $1, redeem_points = $2, redeem_value = $3, expiry_days = $4", settings.PointsPerReal, settings.RedeemPoints, settings.RedeemValue, settings.ExpiryDays); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update loyalty settings"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Loyalty settings successfully updated!"})
+}
+
+func getLoyaltyByUser(c *gin.Context) {
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	points, err := getLoyaltyPointsUser(IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+
+	settings, err := getLoyaltySettingsDB()
+	if err != nil {
+		log.Println(err)
+	}
+
+	rows, err := db.Query("SELECT id, COALESCE(id_fare::text, ''), points, remaining, expires_at, date FROM loyalty_points WHERE id_user = $1 ORDER BY date DESC", IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var history []LoyaltyPoints
+	for rows.Next() {
+		var p LoyaltyPoints
+		err := rows.Scan(&p.ID, &p.IdFare, &p.Points, &p.Remaining, &p.ExpiresAt, &p.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		history = append(history, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"points": points, "redeem_points": settings.RedeemPoints, "redeem_value": settings.RedeemValue, "history": history})
+}
+
+func redeemLoyaltyPoints(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var redeem LoyaltyRedeem
+
+	if err := c.ShouldBindJSON(&redeem); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	settings, err := getLoyaltySettingsDB()
+	if err != nil {
+		log.Println(err)
+	}
+
+	if redeem.Points%settings.RedeemPoints != 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Os pontos devem ser resgatados em múltiplos de %d", settings.RedeemPoints)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem points"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Spend the points closest to expiring first. The rows stay locked until the
+	// commit, so a concurrent redemption cannot spend them in between
+	rows, err := tx.Query("SELECT id, remaining FROM loyalty_points WHERE id_user = $1 AND remaining > 0 AND COALESCE(NULLIF(expires_at, '')::timestamptz > now(), TRUE) ORDER BY NULLIF(expires_at, '')::timestamptz NULLS LAST, date FOR UPDATE", IdUserToken)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem points"})
+		return
+	}
+
+	points := 0
+	var entries []LoyaltyPoints
+	for rows.Next() {
+		var p LoyaltyPoints
+		if err := rows.Scan(&p.ID, &p.Remaining); err != nil {
+			log.Println(err)
+			continue
+		}
+		points += p.Remaining
+		entries = append(entries, p)
+	}
+	rows.Close()
+
+	if points < redeem.Points {
+		c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": fmt.Sprintf("Pontos insuficientes, Pontos: %d", points)})
+		return
+	}
+
+	spent := 0
+	for _, p := range entries {
+		if spent == redeem.Points {
+			break
+		}
+
+		take := min(p.Remaining, redeem.Points-spent)
+
+		if _, err := tx.Exec("UPDATE loyalty_points SET remaining = remaining - $1 WHERE id = $2", take, p.ID); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem points"})
+			return
+		}
+
+		spent += take
+	}
+
+	value := float64(spent/settings.RedeemPoints) * settings.RedeemValue
+
+	balance, err := creditWalletUserTx(tx, IdUserToken, PersonalWallet, value, LoyaltyCredit)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem points"})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	if _, err := tx.Exec("INSERT INTO loyalty_redemptions (id, id_user, points, value, date) VALUES ($1, $2, $3, $4, $5)", uuid.New(), IdUserToken, spent, value, createDateString(time)); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem points"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem points"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Pontos resgatados com sucesso!", "points": spent, "value": value, "balance": balance})
+}
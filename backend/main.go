@@ -53,11 +53,36 @@ type Address struct {
 }
 
 type Bus struct {
-	ID     string  `json:"id,omitempty"`
-	Name   string  `json:"name" binding:"required"`
-	Route  string  `json:"route" binding:"required"`
-	Fare   float64 `json:"fare" binding:"required"`
-	Active bool    `json:"active" binding:"required"`
+	ID      string  `json:"id,omitempty"`
+	Name    string  `json:"name" binding:"required"`
+	Route   string  `json:"route" binding:"required_without=IdRoute"`
+	IdRoute string  `json:"id_route,omitempty" binding:"omitempty,uuid"`
+	Fare    float64 `json:"fare" binding:"required"`
+	Active  bool    `json:"active" binding:"required"`
+	// Estimated passengers on board, filled when listing buses
+	Occupancy *Occupancy `json:"occupancy,omitempty"`
+	// Shift in progress and its driver, recorded with fares and positions
+	IdShift  string `json:"-"`
+	IdDriver string `json:"-"`
+	// Tap-out of the route and boarding zone, used to open journeys
+	TapOut bool   `json:"-"`
+	IdZone string `json:"-"`
+}
+
+type BusUpdate struct {
+	Name    string  `json:"name" binding:"required,lte=60"`
+	Route   string  `json:"route" binding:"required_without=IdRoute,lte=60"`
+	IdRoute string  `json:"id_route" binding:"omitempty,uuid"`
+	Fare    float64 `json:"fare" binding:"required,gt=0"`
+	Active  *bool   `json:"active" binding:"required"`
+}
+
+type BusPatch struct {
+	Name    *string  `json:"name" binding:"omitempty,gt=0,lte=60"`
+	Route   *string  `json:"route" binding:"omitempty,gt=0,lte=60"`
+	IdRoute *string  `json:"id_route"`
+	Fare    *float64 `json:"fare" binding:"omitempty,gt=0"`
+	Active  *bool    `json:"active"`
 }
 
 type BusStats struct {
@@ -69,25 +94,36 @@ type BusStats struct {
 }
 
 type BusAndStats struct {
-	ID    string  `json:"id,omitempty"`
-	Name  string  `json:"name" binding:"required"`
-	Route string  `json:"route" binding:"required"`
-	Fare  float64 `json:"fare" binding:"required"`
-	Lat   float64 `json:"lat" binding:"required"`
-	Lng   float64 `json:"lng" binding:"required"`
-	Date  string  `json:"date,omitempty"`
+	ID         string     `json:"id,omitempty"`
+	Name       string     `json:"name" binding:"required"`
+	Route      string     `json:"route" binding:"required"`
+	IdRoute    string     `json:"id_route,omitempty"`
+	RouteColor string     `json:"route_color,omitempty"`
+	Fare       float64    `json:"fare" binding:"required"`
+	Lat        float64    `json:"lat" binding:"required"`
+	Lng        float64    `json:"lng" binding:"required"`
+	Date       string     `json:"date,omitempty"`
+	Occupancy  *Occupancy `json:"occupancy,omitempty"`
 }
 
 type Uid struct {
-	Uid    string `json:"uid" binding:"required"`
-	IdUser string `json:"id_user,omitempty"`
+	Uid             string     `json:"uid" binding:"required"`
+	IdUser          string     `json:"id_user,omitempty"`
+	Label           string     `json:"label,omitempty"`
+	Status          CardStatus `json:"status,omitempty"`
+	ReplacedBy      string     `json:"replaced_by,omitempty"`
+	Balance         float64    `json:"balance,omitempty"`
+	DailySpendLimit float64    `json:"daily_spend_limit,omitempty"`
+	DailyRideLimit  int        `json:"daily_ride_limit,omitempty"`
+	Date            string     `json:"date,omitempty"`
 }
 
 type Fare struct {
 	ID     string  `json:"id,omitempty"`
 	IdBus  string  `json:"id_bus" binding:"required"`
 	IdUser string  `json:"id_user,omitempty"`
-	Uid    string  `json:"uid" binding:"required"`
+	Uid    string  `json:"uid" binding:"required_without=Qr"`
+	Qr     string  `json:"qr,omitempty"`
 	Fare   float64 `json:"fare,omitempty"`
 	Date   string  `json:"date,omitempty"`
 	User   *User   `json:"user,omitempty"`
@@ -98,27 +134,45 @@ type FareHistory struct {
 	Date    string  `json:"date"`
 	NameBus string  `json:"name_bus"`
 	FareBus float64 `json:"fare_bus"`
+	Pass    bool    `json:"pass"`
 }
 
 type BalanceHistoryType string
 
 const (
-	PIX        BalanceHistoryType = "PIX"
-	CardCredit BalanceHistoryType = "CREDIT_CARD"
+	PIX            BalanceHistoryType = "PIX"
+	CardCredit     BalanceHistoryType = "CREDIT_CARD"
+	Voucher        BalanceHistoryType = "VOUCHER"
+	PassPurchase   BalanceHistoryType = "PASS_PURCHASE"
+	FarePayment    BalanceHistoryType = "FARE"
+	FareRefund     BalanceHistoryType = "FARE_REFUND"
+	EmployerCredit BalanceHistoryType = "EMPLOYER_CREDIT"
+	LoyaltyCredit  BalanceHistoryType = "LOYALTY"
+	Cash           BalanceHistoryType = "CASH"
+	CardClaim      BalanceHistoryType = "CARD_CLAIM"
 )
 
 type BalanceHistory struct {
 	ID         string             `json:"id,omitempty"`
 	IdUser     string             `json:"id_bus,omitempty"`
+	IdWallet   string             `json:"id_wallet,omitempty"`
+	Wallet     WalletType         `json:"wallet,omitempty"`
 	OldBalance float64            `json:"old_balance,omitempty"`
 	Balance    float64            `json:"balance,omitempty"`
 	Value      float64            `json:"value" binding:"required"`
-	Type       BalanceHistoryType `json:"type" binding:"required"`
+	Type       BalanceHistoryType `json:"type" binding:"required,oneof=PIX CREDIT_CARD"`
 	Date       string             `json:"date,omitempty"`
 }
 
 var db *sql.DB
 var hub *Hub
+var antiPassback *AntiPassback
+var pinLimiter *PinLimiter
+var gtfsCache *GTFSCache
+var occupancyModel *OccupancyModel
+var busProgress *BusProgress
+var journeyTapOutWindow time.Duration
+var journeyMinRide time.Duration
 
 var JwtSecret []byte
 
@@ -239,30 +293,189 @@ func main() {
 
 	v1 := router.Group("v1")
 
-	// admin := v1.Group("admin")
+	admin := v1.Group("admin")
+	admin.Use(TokenAuthMiddleware(), AdminAuthMiddleware())
+	admin.GET("/voucher", getVouchers)
+	admin.POST("/voucher", createVoucher)
+	admin.DELETE("/voucher/:id", deactivateVoucher)
+	admin.GET("/pass", getPassProducts)
+	admin.POST("/pass", createPassProduct)
+	admin.DELETE("/pass/:id", deactivatePassProduct)
+	admin.GET("/employer", getEmployers)
+	admin.POST("/employer", createEmployer)
+	admin.POST("/employer/:id/admin", createEmployerAdmin)
+	admin.GET("/loyalty", getLoyaltySettings)
+	admin.PUT("/loyalty", updateLoyaltySettings)
+	admin.GET("/card", getCards)
+	admin.POST("/card", linkCard)
+	admin.DELETE("/card/:uid", unlinkCard)
+	admin.PATCH("/card/:uid/status", updateCardStatus)
+	admin.POST("/card/anonymous", issueAnonymousCard)
+	admin.POST("/card/:uid/topup", topUpAnonymousCard)
+	admin.GET("/card/:uid/history", getAnonymousCardHistory)
+	admin.GET("/inventory", getInventory)
+	admin.GET("/inventory/summary", getInventorySummary)
+	admin.POST("/inventory/import", importInventoryCSV)
+	admin.PATCH("/inventory/:uid/status", updateInventoryStatus)
+	admin.POST("/inventory/:uid/issue", issueInventoryCard)
+	admin.GET("/route", getRoutes)
+	admin.POST("/route", createRoute)
+	admin.PUT("/route/:id", updateRoute)
+	admin.DELETE("/route/:id", deactivateRoute)
+	admin.PUT("/route/:id/stops", updateRouteStops)
+	admin.PUT("/route/:id/zone-fares", updateRouteZoneFares)
+	admin.PUT("/route/:id/timetable", updateRouteTimetable)
+	admin.GET("/stop", getStops)
+	admin.POST("/stop", createStop)
+	admin.PUT("/stop/:id", updateStop)
+	admin.DELETE("/stop/:id", deactivateStop)
+	admin.POST("/stop/:id/activate", activateStop)
+	admin.GET("/zone", getZones)
+	admin.POST("/zone", createZone)
+	admin.PUT("/zone/:id", updateZone)
+	admin.DELETE("/zone/:id", deactivateZone)
+	admin.POST("/gtfs/import", importGTFS)
+	admin.GET("/calendar", getServiceCalendars)
+	admin.POST("/calendar", createServiceCalendar)
+	admin.PUT("/calendar/:id", updateServiceCalendar)
+	admin.DELETE("/calendar/:id", deleteServiceCalendar)
+	admin.GET("/holiday", getHolidays)
+	admin.POST("/holiday", createHoliday)
+	admin.DELETE("/holiday/:date", deleteHoliday)
+	admin.GET("/report/adherence", getAdherenceReport)
+	admin.GET("/driver", getDrivers)
+	admin.POST("/driver", createDriver)
+	admin.DELETE("/driver/:id", deactivateDriver)
+	admin.GET("/shift", getShifts)
+	admin.POST("/bus/:id/token", createBusToken)
+
+	employer := v1.Group("employer")
+	employer.Use(TokenAuthMiddleware(), EmployerAuthMiddleware())
+	employer.GET("/employee", getEmployees)
+	employer.POST("/employee", createEmployee)
+	employer.DELETE("/employee/:id", deleteEmployee)
+	employer.POST("/credit", createBulkCredit)
+	employer.POST("/credit/csv", createBulkCreditCSV)
+	employer.GET("/invoice", getEmployerInvoices)
+	employer.GET("/invoice/:id", getEmployerInvoice)
+
+	route := v1.Group("route")
+	route.GET("/", getRoutes)
+	route.GET("/:id", getRoute)
+	route.GET("/:id/stops", getStopsByRoute)
+	route.GET("/:id/zone-fares", getZoneFaresByRoute)
+	route.GET("/:id/timetable", getRouteTimetable)
+
+	zone := v1.Group("zone")
+	zone.GET("/", getZones)
+
+	stop := v1.Group("stop")
+	stop.GET("/", getStops)
+	stop.GET("/:id", getStop)
+	stop.GET("/:id/arrivals", getArrivalsByStop)
+
+	gtfs := v1.Group("gtfs")
+	gtfs.GET("/static.zip", getGTFSFeed)
+	gtfs.GET("/realtime/vehicle-positions", getVehiclePositionsFeed)
+	gtfs.GET("/realtime/vehicle-positions.json", getVehiclePositionsJSON)
 
 	bus := v1.Group("bus")
 	bus.GET("/", getBuses)
 	bus.GET("/:id", getBus)
 	bus.GET("/:id/stats", getBusStats)
 	bus.POST("/", createBus)
+	bus.PUT("/:id", TokenAuthMiddleware(), AdminAuthMiddleware(), updateBus)
+	bus.PATCH("/:id", TokenAuthMiddleware(), AdminAuthMiddleware(), patchBus)
+	bus.DELETE("/:id", TokenAuthMiddleware(), AdminAuthMiddleware(), deleteBus)
 	bus.POST("/:id/stats", createBusStats)
+	bus.POST("/:id/occupancy", createBusOccupancy)
+	bus.GET("/:id/shift", getShiftByBus)
+	bus.POST("/:id/shift/start", BusAuthMiddleware(), startShiftByBus)
+	bus.POST("/:id/shift/end", BusAuthMiddleware(), endShiftByBus)
 	bus.POST("/fare", createFare)
 
 	auth := v1.Group("auth")
 	auth.POST("/register", createUser)
 	auth.POST("/login", signInUser)
+	auth.POST("/admin/login", signInAdmin)
+	auth.POST("/employer/login", signInEmployer)
 
 	user := v1.Group("user")
-	user.Use(TokenAuthMiddleware())
+	user.Use(TokenAuthMiddleware(), UserAuthMiddleware())
 	user.GET("/info/basic", getBasicInfoUser)
 	user.GET("/info/dashboard", getDashboardInfoUser)
 	user.GET("/fare/history", getFaresByUser)
 	user.GET("/balance/history", getBalanceHistoryByUser)
 	user.POST("/balance/add", addBalanceUser)
+	user.GET("/wallet", getWalletsByUser)
+	user.GET("/loyalty", getLoyaltyByUser)
+	user.POST("/loyalty/redeem", redeemLoyaltyPoints)
+	user.GET("/card", getCardsByUser)
+	user.POST("/card", linkCardByUser)
+	user.DELETE("/card/:uid", unlinkCardByUser)
+	user.POST("/card/:uid/lost", reportLostCardByUser)
+	user.POST("/card/:uid/block", blockCardByUser)
+	user.POST("/card/:uid/unblock", unblockCardByUser)
+	user.POST("/card/:uid/replace", replaceCardByUser)
+	user.POST("/card/claim", claimAnonymousCard)
+	user.PUT("/card/:uid", updateCardByUser)
+	user.POST("/ticket/qr", createQRTicket)
+	user.POST("/voucher/redeem", redeemVoucher)
+	user.GET("/pass", getPassesByUser)
+	user.GET("/journey", getJourneysByUser)
+	user.GET("/pass/products", getPassProducts)
+	user.POST("/pass/purchase", purchasePassUser)
 
 	hub = NewHub()
 
+	antiPassbackSeconds := viper.GetInt("ANTI_PASSBACK_SECONDS")
+	if antiPassbackSeconds <= 0 {
+		antiPassbackSeconds = 60
+	}
+	antiPassback = NewAntiPassback(time.Duration(antiPassbackSeconds) * time.Second)
+
+	driverPinAttempts := viper.GetInt("DRIVER_PIN_ATTEMPTS")
+	if driverPinAttempts <= 0 {
+		driverPinAttempts = 5
+	}
+	pinLimiter = NewPinLimiter(driverPinAttempts, 15*time.Minute)
+
+	gtfsCacheSeconds := viper.GetInt("GTFS_CACHE_SECONDS")
+	if gtfsCacheSeconds <= 0 {
+		gtfsCacheSeconds = 3600
+	}
+	gtfsCache = NewGTFSCache(time.Duration(gtfsCacheSeconds) * time.Second)
+
+	busCapacity := viper.GetInt("BUS_CAPACITY")
+	if busCapacity <= 0 {
+		busCapacity = 70
+	}
+	rideMinutes := viper.GetInt("OCCUPANCY_RIDE_MINUTES")
+	if rideMinutes <= 0 {
+		rideMinutes = 20
+	}
+	occupancyModel = NewOccupancyModel(busCapacity, time.Duration(rideMinutes)*time.Minute)
+
+	busProgress = NewBusProgress()
+
+	journeyMaxMinutes := viper.GetInt("JOURNEY_MAX_MINUTES")
+	if journeyMaxMinutes <= 0 {
+		journeyMaxMinutes = 180
+	}
+	go runJourneyAutoClose(time.Duration(journeyMaxMinutes)*time.Minute, time.Minute)
+
+	journeyTapOutMinutes := viper.GetInt("JOURNEY_TAP_OUT_MINUTES")
+	if journeyTapOutMinutes <= 0 {
+		journeyTapOutMinutes = 90
+	}
+	journeyTapOutWindow = time.Duration(journeyTapOutMinutes) * time.Minute
+
+	journeyMinRideSeconds := viper.GetInt("JOURNEY_MIN_RIDE_SECONDS")
+	if journeyMinRideSeconds <= 0 {
+		journeyMinRideSeconds = 120
+	}
+	journeyMinRide = time.Duration(journeyMinRideSeconds) * time.Second
+
 	v1.GET("/ws", func(ctx *gin.Context) {
 		hub.HandleWS(&ginContextAdapter{c: ctx})
 	})
@@ -296,22 +509,81 @@ func TokenAuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+func AdminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, exists := c.Get("token")
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+
+		token, ok := v.(string)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+
+		role, err := getRoleFromToken(token)
+		if err != nil || role != "ADMIN" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+
+		c.Set("admin", true)
+		c.Next()
+	}
+}
+
+// UserAuthMiddleware keeps the rider routes to rider tokens, employer admins
+// and admins are not users of the wallets and cards behind them.
+func UserAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, exists := c.Get("token")
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+
+		token, ok := v.(string)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+
+		role, err := getRoleFromToken(token)
+		if err != nil || role != "USER" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "User access required"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
 func getBuses(c *gin.Context) {
 	c.Header("Content-Type", "application/json")
 
-	rows, err := db.Query("SELECT id, name, route, fare, active FROM bus")
+	rows, err := db.Query("SELECT b.id, b.name, b.route, COALESCE(b.id_route::text, ''), COALESCE(r.fare, b.fare), b.active FROM bus b LEFT JOIN routes r ON r.id = b.id_route AND r.active IS TRUE WHERE b.deleted_at IS NULL")
 	if err != nil {
 		log.Println(err)
 	}
 	defer rows.Close()
 
+	occupancies, err := occupancyModel.Estimate()
+	if err != nil {
+		log.Println(err)
+	}
+
 	var buses []Bus
 	for rows.Next() {
 		var a Bus
-		err := rows.Scan(&a.ID, &a.Name, &a.Route, &a.Fare, &a.Active)
+		err := rows.Scan(&a.ID, &a.Name, &a.Route, &a.IdRoute, &a.Fare, &a.Active)
 		if err != nil {
 			log.Println(err)
 		}
+		if occupancy, ok := occupancies[a.ID]; ok {
+			a.Occupancy = &occupancy
+		}
 		buses = append(buses, a)
 	}
 	err = rows.Err()
@@ -333,9 +605,9 @@ func getBus(c *gin.Context) {
 	}
 
 	var bus Bus
-	row := db.QueryRow("SELECT id, name, route, fare, active FROM bus WHERE id = $1", id)
+	row := db.QueryRow("SELECT b.id, b.name, b.route, COALESCE(b.id_route::text, ''), COALESCE(r.fare, b.fare), b.active FROM bus b LEFT JOIN routes r ON r.id = b.id_route AND r.active IS TRUE WHERE b.id = $1 AND b.deleted_at IS NULL", id)
 
-	err := row.Scan(&bus.ID, &bus.Name, &bus.Route, &bus.Fare, &bus.Active)
+	err := row.Scan(&bus.ID, &bus.Name, &bus.Route, &bus.IdRoute, &bus.Fare, &bus.Active)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -346,6 +618,13 @@ func getBus(c *gin.Context) {
 		}
 	}
 
+	occupancy, err := occupancyModel.EstimateBus(bus.ID)
+	if err != nil {
+		log.Println(err)
+	} else {
+		bus.Occupancy = &occupancy
+	}
+
 	c.IndentedJSON(http.StatusOK, bus)
 }
 
@@ -407,9 +686,9 @@ func getBasicInfoUser(c *gin.Context) {
 	}
 
 	var user User
-	row := db.QueryRow("SELECT image, name, surname, balance FROM users WHERE id = $1;", IdUserToken)
+	row := db.QueryRow("SELECT image, name, surname FROM users WHERE id = $1;", IdUserToken)
 
-	err_row := row.Scan(&user.Image, &user.Name, &user.Surname, &user.Balance)
+	err_row := row.Scan(&user.Image, &user.Name, &user.Surname)
 
 	if err_row != nil {
 		if err_row == sql.ErrNoRows {
@@ -420,6 +699,11 @@ func getBasicInfoUser(c *gin.Context) {
 		}
 	}
 
+	user.Balance, err = getBalanceUser(IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+
 	c.IndentedJSON(http.StatusOK, gin.H{"image": user.Image, "name": user.Name, "surname": user.Surname, "balance": user.Balance})
 }
 
@@ -443,9 +727,9 @@ func getDashboardInfoUser(c *gin.Context) {
 	}
 
 	var user User
-	row := db.QueryRow("SELECT id, image, name, surname, balance FROM users WHERE id = $1", IdUserToken)
+	row := db.QueryRow("SELECT id, image, name, surname FROM users WHERE id = $1", IdUserToken)
 
-	err_row := row.Scan(&user.ID, &user.Image, &user.Name, &user.Surname, &user.Balance)
+	err_row := row.Scan(&user.ID, &user.Image, &user.Name, &user.Surname)
 
 	if err_row != nil {
 		if err_row == sql.ErrNoRows {
@@ -456,7 +740,21 @@ func getDashboardInfoUser(c *gin.Context) {
 		}
 	}
 
-	rows, err := db.Query("SELECT f.date, b.fare FROM fares f LEFT JOIN bus b ON b.id = f.id_bus WHERE f.id_user = $1", IdUserToken)
+	wallets, err := getWalletsUser(IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+
+	for _, w := range wallets {
+		user.Balance += w.Balance
+	}
+
+	points, err := getLoyaltyPointsUser(IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+
+	rows, err := db.Query("SELECT f.date, CASE WHEN f.id_user_pass IS NULL THEN COALESCE(f.fare, b.fare) ELSE 0 END FROM fares f LEFT JOIN bus b ON b.id = f.id_bus WHERE f.id_user = $1", IdUserToken)
 	if err != nil {
 		log.Println(err)
 	}
@@ -504,20 +802,28 @@ func getDashboardInfoUser(c *gin.Context) {
 		totalValorMes = 0.0
 	}
 
-	rows_bus, err := db.Query("SELECT b.id, b.name, b.fare, b.route, bs.lat, bs.lng, bs.date FROM bus b INNER JOIN (SELECT DISTINCT ON (id_bus) * FROM bus_stats ORDER BY id_bus, date::timestamptz DESC) bs ON b.id = bs.id_bus WHERE b.active IS TRUE;")
+	rows_bus, err := db.Query("SELECT b.id, b.name, COALESCE(r.fare, b.fare), b.route, COALESCE(b.id_route::text, ''), COALESCE(r.color, ''), bs.lat, bs.lng, bs.date FROM bus b LEFT JOIN routes r ON r.id = b.id_route AND r.active IS TRUE INNER JOIN (SELECT DISTINCT ON (id_bus) * FROM bus_stats ORDER BY id_bus, date::timestamptz DESC) bs ON b.id = bs.id_bus WHERE b.active IS TRUE;")
 	if err != nil {
 		log.Println(err)
 	}
 	defer rows_bus.Close()
 
+	occupancies, err := occupancyModel.Estimate()
+	if err != nil {
+		log.Println(err)
+	}
+
 	var busAndStats []BusAndStats
 
 	for rows_bus.Next() {
 		var b BusAndStats
-		err := rows_bus.Scan(&b.ID, &b.Name, &b.Fare, &b.Route, &b.Lat, &b.Lng, &b.Date)
+		err := rows_bus.Scan(&b.ID, &b.Name, &b.Fare, &b.Route, &b.IdRoute, &b.RouteColor, &b.Lat, &b.Lng, &b.Date)
 		if err != nil {
 			log.Println(err)
 		}
+		if occupancy, ok := occupancies[b.ID]; ok {
+			b.Occupancy = &occupancy
+		}
 
 		busAndStats = append(busAndStats, b)
 	}
@@ -527,7 +833,7 @@ func getDashboardInfoUser(c *gin.Context) {
 		log.Println(err)
 	}
 
-	c.IndentedJSON(http.StatusOK, gin.H{"id": user.ID, "image": user.Image, "name": user.Name, "surname": user.Surname, "balance": user.Balance, "totalRoutes": totalMes, "totalSpendMonth": totalValorMes, "buses": busAndStats})
+	c.IndentedJSON(http.StatusOK, gin.H{"id": user.ID, "image": user.Image, "name": user.Name, "surname": user.Surname, "balance": user.Balance, "wallets": wallets, "points": points, "totalRoutes": totalMes, "totalSpendMonth": totalValorMes, "buses": busAndStats})
 }
 
 func getFaresByUser(c *gin.Context) {
@@ -549,7 +855,7 @@ func getFaresByUser(c *gin.Context) {
 		return
 	}
 
-	rows, err := db.Query("SELECT f.id as id, f.date as date, b.name as bus_name, b.fare as bus_fare FROM fares f JOIN bus b ON b.id = f.id_bus WHERE f.id_user = $1 ORDER BY f.date DESC;", IdUserToken)
+	rows, err := db.Query("SELECT f.id as id, f.date as date, b.name as bus_name, CASE WHEN f.id_user_pass IS NULL THEN COALESCE(f.fare, b.fare) ELSE 0 END as bus_fare, f.id_user_pass IS NOT NULL as pass FROM fares f JOIN bus b ON b.id = f.id_bus WHERE f.id_user = $1 ORDER BY f.date DESC;", IdUserToken)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + IdUserToken})
@@ -564,7 +870,7 @@ func getFaresByUser(c *gin.Context) {
 
 	for rows.Next() {
 		var a FareHistory
-		err := rows.Scan(&a.ID, &a.Date, &a.NameBus, &a.FareBus)
+		err := rows.Scan(&a.ID, &a.Date, &a.NameBus, &a.FareBus, &a.Pass)
 		if err != nil {
 			log.Println(err)
 		}
@@ -598,7 +904,13 @@ func getBalanceHistoryByUser(c *gin.Context) {
 		return
 	}
 
-	rows, err := db.Query("SELECT id, id_user, old_balance, balance, value, type, date FROM balance_history WHERE id_user = $1 ORDER BY date DESC;", IdUserToken)
+	walletType := c.Query("wallet")
+	if walletType != "" && walletType != string(PersonalWallet) && walletType != string(ValeTransporteWallet) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid wallet type: " + walletType})
+		return
+	}
+
+	rows, err := db.Query("SELECT bh.id, bh.id_user, COALESCE(bh.id_wallet::text, ''), COALESCE(w.type, ''), bh.old_balance, bh.balance, bh.value, bh.type, bh.date FROM balance_history bh LEFT JOIN wallets w ON w.id = bh.id_wallet WHERE bh.id_user = $1 AND ($2 = '' OR w.type = $2) ORDER BY bh.date DESC;", IdUserToken, walletType)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + IdUserToken})
@@ -613,7 +925,7 @@ func getBalanceHistoryByUser(c *gin.Context) {
 
 	for rows.Next() {
 		var b BalanceHistory
-		err := rows.Scan(&b.ID, &b.IdUser, &b.OldBalance, &b.Balance, &b.Value, &b.Type, &b.Date)
+		err := rows.Scan(&b.ID, &b.IdUser, &b.IdWallet, &b.Wallet, &b.OldBalance, &b.Balance, &b.Value, &b.Type, &b.Date)
 		if err != nil {
 			log.Println(err)
 		}
@@ -635,6 +947,10 @@ func createDateString(time time.Time) string {
 	return time.Format("2006-01-02T15:04:05-0700")
 }
 
+func parseDateString(date string) (time.Time, error) {
+	return time.Parse("2006-01-02T15:04:05-0700", date)
+}
+
 func addBalanceUser(c *gin.Context) {
 	c.Header("Content-Type", "application/json")
 
@@ -672,46 +988,17 @@ func addBalanceUser(c *gin.Context) {
 		return
 	}
 
-	var user User
-	row_user := db.QueryRow("SELECT balance FROM users WHERE id = $1;", IdUserToken)
-
-	err_user := row_user.Scan(&user.Balance)
-
-	if err_user != nil {
-		if err_user == sql.ErrNoRows {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with UID: " + IdUserToken})
+	balance, err := creditWalletUser(IdUserToken, PersonalWallet, BalanceHistory.Value, BalanceHistory.Type)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + IdUserToken})
 			return
 		} else {
-			log.Println(err_user)
+			log.Println(err)
 		}
 	}
 
-	stmt_update, err := db.Prepare("UPDATE users SET balance = $1 WHERE id = $2")
-	if err != nil {
-		log.Println(err)
-	}
-	defer stmt_update.Close()
-
-	if _, err := stmt_update.Exec((user.Balance + BalanceHistory.Value), IdUserToken); err != nil {
-		log.Println(err)
-	}
-
-	stmt, err := db.Prepare("INSERT INTO balance_history (id, id_user, old_balance, balance, value, type, date) VALUES ($1, $2, $3, $4, $5, $6, $7)")
-	if err != nil {
-		log.Println(err)
-	}
-	defer stmt.Close()
-
-	id_balance_history := uuid.New()
-
-	loc := time.FixedZone("BRT", -3*60*60)
-	time := time.Now().In(loc)
-
-	if _, err := stmt.Exec(id_balance_history, IdUserToken, (user.Balance + BalanceHistory.Value), user.Balance, BalanceHistory.Value, BalanceHistory.Type, createDateString(time)); err != nil {
-		log.Println(err)
-	}
-
-	c.IndentedJSON(http.StatusOK, gin.H{"message": "Saldo adicionado com sucesso!"})
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Saldo adicionado com sucesso!", "balance": balance})
 }
 
 func createFare(c *gin.Context) {
@@ -734,9 +1021,9 @@ func createFare(c *gin.Context) {
 	}
 
 	var bus Bus
-	row_bus := db.QueryRow("SELECT id, name, fare FROM bus WHERE id = $1", fare.IdBus)
+	row_bus := db.QueryRow("SELECT b.id, b.name, b.route, COALESCE(r.id::text, ''), COALESCE(r.fare, b.fare), COALESCE(r.tap_out, FALSE), COALESCE(s.id::text, ''), COALESCE(s.id_driver::text, ''), b.active FROM bus b LEFT JOIN routes r ON r.id = b.id_route AND r.active IS TRUE LEFT JOIN shifts s ON s.id_bus = b.id AND s.ended_at IS NULL WHERE b.id = $1 AND b.deleted_at IS NULL", fare.IdBus)
 
-	err_bus := row_bus.Scan(&bus.ID, &bus.Name, &bus.Fare)
+	err_bus := row_bus.Scan(&bus.ID, &bus.Name, &bus.Route, &bus.IdRoute, &bus.Fare, &bus.TapOut, &bus.IdShift, &bus.IdDriver, &bus.Active)
 
 	if err_bus != nil {
 		if err_bus == sql.ErrNoRows {
@@ -747,10 +1034,134 @@ func createFare(c *gin.Context) {
 		}
 	}
 
+	// A bus taken out of service must not keep charging fares
+	if !bus.Active {
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "BUS_INACTIVE", "message": "Ônibus fora de operação"}})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Bus is inactive"})
+		return
+	}
+
+	// Routes priced by zone charge from the zone the bus is in at tap time
+	if zoneFare, zone, ok := getBusZoneFare(bus); ok {
+		bus.Fare = zoneFare
+		bus.IdZone = zone.ID
+	}
+
+	if fare.Qr != "" {
+		createQRFare(c, bus, fare.Qr)
+		return
+	}
+
+	uid, err := normalizeUID(fare.Uid)
+	if err != nil {
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "INVALID_CARD", "message": "Cartão não reconhecido, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid UID: " + fare.Uid, "errors": err.Error()})
+		return
+	}
+	fare.Uid = uid
+
+	// Driver badges tapped on the validator start or end their shift, which
+	// only the validator of the bus may do
+	driver, err := findDriverByUid(fare.Uid)
+	if err == nil {
+		ok, err := verifyBusToken(c.Request.Header.Get("Authorization"), bus.ID)
+		if err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot verify bus token"})
+			return
+		}
+		if !ok {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "VALIDATOR_NOT_AUTHORIZED", "message": "Validador não autorizado, procure a garagem"}})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing bus token"})
+			return
+		}
+
+		toggleDriverShift(c, bus, driver)
+		return
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+	}
+
+	var card Uid
+	row_card := db.QueryRow("SELECT uid, COALESCE(id_user::text, ''), status, balance, COALESCE(daily_spend_limit, 0), COALESCE(daily_ride_limit, 0) FROM uids WHERE uid = $1", fare.Uid)
+
+	err_card := row_card.Scan(&card.Uid, &card.IdUser, &card.Status, &card.Balance, &card.DailySpendLimit, &card.DailyRideLimit)
+
+	if err_card != nil {
+		if err_card == sql.ErrNoRows {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "USER_NOT_FOUND", "message": "Nenhum usuário encontrado com este cartão"}})
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with UID: " + fare.Uid})
+			return
+		} else {
+			log.Println(err_card)
+		}
+	}
+
+	if card.Status != CardActive {
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "CARD_BLOCKED", "message": "Cartão bloqueado, procure o atendimento"}})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Card is not active, status: " + string(card.Status)})
+		return
+	}
+
+	// A second tap right after the first, or a card held on the reader, is
+	// neither a new ride nor a tap-out
+	recentFare, err := antiPassback.recentFareExists(card.Uid, bus.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if recentFare || !antiPassback.Reserve(card.Uid, bus.ID) {
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "ALREADY_VALIDATED", "message": "Passagem já validada"}})
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Card already validated on this bus, UID: " + card.Uid})
+		return
+	}
+
+	// Taps that were not charged must not block the next attempt
+	defer func() {
+		if c.Writer.Status() != http.StatusOK {
+			antiPassback.Release(card.Uid, bus.ID)
+		}
+	}()
+
+	// A card with an open journey taps out on the bus it boarded, any other
+	// tap means the tap-out was missed and the journey keeps its maximum fare
+	journey, err := getOpenJourney(card.Uid)
+	if err == nil {
+		if isTapOut(bus, journey) {
+			if isRideTooShort(bus, journey) {
+				hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "ALREADY_VALIDATED", "message": "Passagem já validada"}})
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Journey just started on this bus, UID: " + card.Uid})
+				return
+			}
+
+			settleJourney(c, bus, journey)
+			return
+		}
+
+		if err := autoCloseJourney(journey.ID); err != nil {
+			log.Println(err)
+		}
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+	}
+
+	if card.IdUser == "" {
+		if limit, err := checkCardLimits(card, bus.Fare); err != nil {
+			log.Println(err)
+		} else if limit != "" {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "CARD_LIMIT_REACHED", "limit": limit, "message": "Limite diário do cartão atingido"}})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Card daily limit reached: " + limit})
+			return
+		}
+
+		createAnonymousFare(c, bus, card)
+		return
+	}
+
 	var user User
-	row_user := db.QueryRow("SELECT us.id, us.image, us.name, us.surname, us.balance FROM users us LEFT JOIN uids ui ON ui.id_user = us.id WHERE ui.uid = $1", fare.Uid)
+	row_user := db.QueryRow("SELECT id, image, name, surname FROM users WHERE id = $1", card.IdUser)
 
-	err_user := row_user.Scan(&user.ID, &user.Image, &user.Name, &user.Surname, &user.Balance)
+	err_user := row_user.Scan(&user.ID, &user.Image, &user.Name, &user.Surname)
 
 	if err_user != nil {
 		if err_user == sql.ErrNoRows {
@@ -762,39 +1173,139 @@ func createFare(c *gin.Context) {
 		}
 	}
 
-	if (user.Balance - bus.Fare) < 0 {
-		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "INSUFFICIENT_BALANCE", "message": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", user.Balance)}})
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", user.Balance)})
-		return
+	chargeFareUser(c, bus, user, card)
+}
+
+// chargeFareUser records a ride of the user on the bus, covered by an active
+// pass or paid from the wallets. card is empty when the ride has no card.
+func chargeFareUser(c *gin.Context, bus Bus, user User, card Uid) {
+	// Rides without a card cannot tap out
+	if card.Uid == "" {
+		bus.TapOut = false
 	}
 
-	stmt, err := db.Prepare("INSERT INTO fares (id, id_bus, id_user, date) VALUES ($1, $2, $3, $4)")
+	balance, err := getBalanceUser(user.ID)
 	if err != nil {
 		log.Println(err)
 	}
-	defer stmt.Close()
+	user.Balance = balance
 
-	id_fare := uuid.New()
+	id_user_pass, err := findActivePassUser(user.ID, bus.Route)
+	if err != nil {
+		log.Println(err)
+	}
+
+	charge := bus.Fare
+	if id_user_pass != "" {
+		charge = 0
+	}
+
+	if limit, err := checkCardLimits(card, charge); err != nil {
+		log.Println(err)
+	} else if limit != "" {
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "CARD_LIMIT_REACHED", "limit": limit, "message": "Limite diário do cartão atingido"}})
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Card daily limit reached: " + limit})
+		return
+	}
 
 	loc := time.FixedZone("BRT", -3*60*60)
 	time := time.Now().In(loc)
 
-	if _, err := stmt.Exec(id_fare, bus.ID, user.ID, createDateString(time)); err != nil {
+	if id_user_pass != "" {
+		id_fare := uuid.New()
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("INSERT INTO fares (id, id_bus, id_user, uid, id_user_pass, fare, date, id_shift, id_driver) VALUES ($1, $2, $3, NULLIF($4, ''), $5, 0, $6, NULLIF($7, '')::uuid, NULLIF($8, '')::uuid)", id_fare, bus.ID, user.ID, card.Uid, id_user_pass, createDateString(time), bus.IdShift, bus.IdDriver); err != nil {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+			return
+		}
+
+		if err := openJourney(tx, bus, card, user.ID, id_fare.String(), 0, nil); err != nil {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+			return
+		}
+
+		hub.BroadcastToID(bus.ID, gin.H{"type": "success", "id": user.ID, "image": user.Image, "name": user.Name, "surname": user.Surname, "fare": 0, "pass": true, "tap_out": bus.TapOut, "old_balance": user.Balance, "balance": user.Balance})
+		c.IndentedJSON(http.StatusOK, gin.H{"id": user.ID, "name": user.Name, "surname": user.Surname, "fare": 0, "pass": true, "old_balance": user.Balance, "balance": user.Balance})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
 		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+		return
 	}
+	defer tx.Rollback()
 
-	stmt_update, err := db.Prepare("UPDATE users SET balance = $1 WHERE id = $2")
+	debits, err := debitFareUser(tx, user.ID, bus.Fare)
 	if err != nil {
+		if err == ErrInsufficientBalance {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "INSUFFICIENT_BALANCE", "message": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", user.Balance)}})
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", user.Balance)})
+			return
+		} else {
+			log.Println(err)
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+			return
+		}
+	}
+
+	id_fare := uuid.New()
+
+	if _, err := tx.Exec("INSERT INTO fares (id, id_bus, id_user, uid, fare, date, id_shift, id_driver) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, NULLIF($7, '')::uuid, NULLIF($8, '')::uuid)", id_fare, bus.ID, user.ID, card.Uid, bus.Fare, createDateString(time), bus.IdShift, bus.IdDriver); err != nil {
 		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+		return
 	}
-	defer stmt_update.Close()
 
-	if _, err := stmt_update.Exec((user.Balance - bus.Fare), user.ID); err != nil {
+	if err := openJourney(tx, bus, card, user.ID, id_fare.String(), bus.Fare, debits); err != nil {
 		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+		return
 	}
 
-	hub.BroadcastToID(bus.ID, gin.H{"type": "success", "id": user.ID, "image": user.Image, "name": user.Name, "surname": user.Surname, "fare": bus.Fare, "old_balance": user.Balance, "balance": (user.Balance - bus.Fare)})
-	c.IndentedJSON(http.StatusOK, gin.H{"id": user.ID, "name": user.Name, "surname": user.Surname, "fare": bus.Fare, "old_balance": user.Balance, "balance": (user.Balance - bus.Fare)})
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "PAYMENT_FAILED", "message": "Não foi possível cobrar a passagem, aproxime novamente"}})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot charge fare"})
+		return
+	}
+
+	// Rides that tap out earn their points once the fare is settled
+	var points int
+	if !bus.TapOut {
+		points, err = accrueLoyaltyPoints(user.ID, id_fare.String(), bus.Fare)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	hub.BroadcastToID(bus.ID, gin.H{"type": "success", "id": user.ID, "image": user.Image, "name": user.Name, "surname": user.Surname, "fare": bus.Fare, "tap_out": bus.TapOut, "old_balance": user.Balance, "balance": (user.Balance - bus.Fare), "wallets": debits, "points": points})
+	c.IndentedJSON(http.StatusOK, gin.H{"id": user.ID, "name": user.Name, "surname": user.Surname, "fare": bus.Fare, "old_balance": user.Balance, "balance": (user.Balance - bus.Fare), "wallets": debits, "points": points})
 }
 
 func signInUser(c *gin.Context) {
@@ -847,6 +1358,50 @@ func signInUser(c *gin.Context) {
 	}
 }
 
+func signInAdmin(c *gin.Context) {
+	var login Login
+
+	if err := c.ShouldBindJSON(&login); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if !validateEmail(login.Login) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Login ou Senha estão incorretos!"})
+		return
+	}
+
+	var user User
+	row_user := db.QueryRow("SELECT id, role, name, surname, password FROM users WHERE role = $1 AND email = $2", "ADMIN", login.Login)
+
+	err_user := row_user.Scan(&user.ID, &user.Role, &user.Name, &user.Surname, &user.Password)
+
+	if err_user != nil {
+		if err_user == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Login ou Senha estão incorretos!"})
+			return
+		} else {
+			log.Println(err_user)
+		}
+	}
+
+	if VerifyPassword(login.Password, user.Password) {
+		token, _ := createToken(user.ID, user.Role)
+		c.IndentedJSON(http.StatusOK, gin.H{"id": user.ID, "name": user.Name, "surname": user.Surname, "role": user.Role, "token": token})
+	} else {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Login ou Senha estão incorretos!"})
+	}
+}
+
 // func getUserByUid(c *gin.Context) {
 // 	c.Header("Content-Type", "application/json")
 
@@ -927,6 +1482,10 @@ func createUser(c *gin.Context) {
 		log.Println(err)
 	}
 
+	if _, err := ensureWalletUser(id_user.String(), PersonalWallet); err != nil {
+		log.Println(err)
+	}
+
 	c.IndentedJSON(http.StatusCreated, gin.H{"message": "User successfully created!", "id": id_user})
 }
 
@@ -938,7 +1497,20 @@ func createBus(c *gin.Context) {
 		return
 	}
 
-	stmt, err := db.Prepare("INSERT INTO bus (id, name, route, fare, active) VALUES ($1, $2, $3, $4, $5)")
+	if bus.IdRoute != "" {
+		code, err := getRouteCode(bus.IdRoute)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No route found with ID: " + bus.IdRoute})
+				return
+			} else {
+				log.Println(err)
+			}
+		}
+		bus.Route = code
+	}
+
+	stmt, err := db.Prepare("INSERT INTO bus (id, name, route, id_route, fare, active) VALUES ($1, $2, $3, NULLIF($4, '')::uuid, $5, $6)")
 	if err != nil {
 		log.Println(err)
 	}
@@ -946,13 +1518,181 @@ func createBus(c *gin.Context) {
 
 	id_bus := uuid.New()
 
-	if _, err := stmt.Exec(id_bus, bus.Name, bus.Route, bus.Fare, bus.Active); err != nil {
+	if _, err := stmt.Exec(id_bus, bus.Name, bus.Route, bus.IdRoute, bus.Fare, bus.Active); err != nil {
 		log.Println(err)
 	}
 
 	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Bus successfully created!", "id": id_bus})
 }
 
+func updateBus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var update BusUpdate
+
+	if err := c.ShouldBindJSON(&update); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	saveBus(c, BusPatch{Name: &update.Name, Route: &update.Route, IdRoute: &update.IdRoute, Fare: &update.Fare, Active: update.Active})
+}
+
+func patchBus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var patch BusPatch
+
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	saveBus(c, patch)
+}
+
+// saveBus applies the fields set in patch to the bus and lets its validator
+// know when the fare it charges changes, so the price on the display stays right.
+// Buses assigned to a route always carry the route code as their route name.
+func saveBus(c *gin.Context, patch BusPatch) {
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var bus Bus
+	row := db.QueryRow("SELECT id, name, route, COALESCE(id_route::text, ''), fare, active FROM bus WHERE id = $1 AND deleted_at IS NULL", id)
+
+	err := row.Scan(&bus.ID, &bus.Name, &bus.Route, &bus.IdRoute, &bus.Fare, &bus.Active)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+			return
+		}
+	}
+
+	oldFare, err := getBusFare(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if patch.Name != nil {
+		bus.Name = strings.TrimSpace(*patch.Name)
+	}
+	if patch.Route != nil {
+		bus.Route = strings.TrimSpace(*patch.Route)
+	}
+	if patch.Fare != nil {
+		bus.Fare = *patch.Fare
+	}
+	if patch.Active != nil {
+		bus.Active = *patch.Active
+	}
+	if patch.IdRoute != nil {
+		bus.IdRoute = *patch.IdRoute
+	}
+
+	if bus.IdRoute != "" {
+		if uuid.Validate(bus.IdRoute) != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+			return
+		}
+
+		code, err := getRouteCode(bus.IdRoute)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No route found with ID: " + bus.IdRoute})
+				return
+			} else {
+				log.Println(err)
+			}
+		}
+		bus.Route = code
+	}
+
+	if bus.Name == "" || bus.Route == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": "name and route cannot be empty"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE bus SET name = $1, route = $2, id_route = NULLIF($3, '')::uuid, fare = $4, active = $5 WHERE id = $6 AND deleted_at IS NULL", bus.Name, bus.Route, bus.IdRoute, bus.Fare, bus.Active, id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	fare, err := getBusFare(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if fare != oldFare {
+		notifyFareChange(bus.ID, oldFare, fare)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Bus successfully updated!", "bus": bus})
+}
+
+// deleteBus only hides the bus, fares and stats keep pointing at it.
+func deleteBus(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	result, err := db.Exec("UPDATE bus SET active = FALSE, deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL", createDateString(time), id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot delete data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Bus successfully deleted!"})
+}
+
 func createBusStats(c *gin.Context) {
 
 	id := c.Param("id")
@@ -963,9 +1703,9 @@ func createBusStats(c *gin.Context) {
 	}
 
 	var bus Bus
-	row := db.QueryRow("SELECT id, name FROM bus WHERE id = $1", id)
+	row := db.QueryRow("SELECT b.id, b.name, COALESCE(b.id_route::text, ''), COALESCE(s.id::text, ''), COALESCE(s.id_driver::text, '') FROM bus b LEFT JOIN shifts s ON s.id_bus = b.id AND s.ended_at IS NULL WHERE b.id = $1 AND b.deleted_at IS NULL", id)
 
-	err := row.Scan(&bus.ID, &bus.Name)
+	err := row.Scan(&bus.ID, &bus.Name, &bus.IdRoute, &bus.IdShift, &bus.IdDriver)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -982,7 +1722,8 @@ func createBusStats(c *gin.Context) {
 		return
 	}
 
-	stmt, err := db.Prepare("INSERT INTO bus_stats (id, id_bus, lat, lng, date) VALUES ($1, $2, $3, $4, $5)")
+	// The route is kept with the position, the bus may run another route later
+	stmt, err := db.Prepare("INSERT INTO bus_stats (id, id_bus, lat, lng, date, id_shift, id_driver, id_route) VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::uuid, NULLIF($7, '')::uuid, NULLIF($8, '')::uuid)")
 	if err != nil {
 		log.Println(err)
 	}
@@ -993,9 +1734,11 @@ func createBusStats(c *gin.Context) {
 	loc := time.FixedZone("BRT", -3*60*60)
 	time := time.Now().In(loc)
 
-	if _, err := stmt.Exec(id_bus_stats, id, bus_stats.Lat, bus_stats.Lng, createDateString(time)); err != nil {
+	if _, err := stmt.Exec(id_bus_stats, id, bus_stats.Lat, bus_stats.Lng, createDateString(time), bus.IdShift, bus.IdDriver, bus.IdRoute); err != nil {
 		log.Println(err)
 	}
 
+	go pushBusPredictions(id)
+
 	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Bus stats successfully created!", "id": id_bus_stats})
 }
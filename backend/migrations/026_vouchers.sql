@@ -0,0 +1,25 @@
+-- Migrations run in file name order with psql against the database the API
+-- uses. Dates are stored as text in the format of createDateString, like the
+-- rest of the schema.
+
+CREATE TABLE IF NOT EXISTS vouchers (
+	id                UUID PRIMARY KEY,
+	code              TEXT NOT NULL UNIQUE,
+	value             NUMERIC(10, 2) NOT NULL CHECK (value > 0),
+	expires_at        TEXT NOT NULL,
+	max_uses          INTEGER NOT NULL DEFAULT 0,
+	max_uses_per_user INTEGER NOT NULL DEFAULT 0,
+	uses              INTEGER NOT NULL DEFAULT 0,
+	active            BOOLEAN NOT NULL DEFAULT TRUE,
+	date              TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS voucher_redemptions (
+	id         UUID PRIMARY KEY,
+	id_voucher UUID NOT NULL REFERENCES vouchers (id),
+	id_user    UUID NOT NULL REFERENCES users (id),
+	value      NUMERIC(10, 2) NOT NULL,
+	date       TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS voucher_redemptions_id_voucher_id_user_idx ON voucher_redemptions (id_voucher, id_user);
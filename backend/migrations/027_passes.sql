@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS pass_products (
+	id     UUID PRIMARY KEY,
+	name   TEXT NOT NULL,
+	period TEXT NOT NULL CHECK (period IN ('WEEKLY', 'MONTHLY')),
+	price  NUMERIC(10, 2) NOT NULL CHECK (price > 0),
+	-- Route codes the pass is valid on, every route when empty
+	routes TEXT[] NOT NULL DEFAULT '{}',
+	active BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS user_passes (
+	id              UUID PRIMARY KEY,
+	id_user         UUID NOT NULL REFERENCES users (id),
+	id_pass_product UUID NOT NULL REFERENCES pass_products (id),
+	starts_at       TEXT NOT NULL,
+	expires_at      TEXT NOT NULL,
+	date            TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_passes_id_user_idx ON user_passes (id_user);
+
+ALTER TABLE fares ADD COLUMN IF NOT EXISTS id_user_pass UUID REFERENCES user_passes (id);
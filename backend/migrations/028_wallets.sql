@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS wallets (
+	id       UUID PRIMARY KEY,
+	id_user  UUID NOT NULL REFERENCES users (id),
+	type     TEXT NOT NULL CHECK (type IN ('PERSONAL', 'VALE_TRANSPORTE')),
+	balance  NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (balance >= 0),
+	priority INTEGER NOT NULL,
+	UNIQUE (id_user, type)
+);
+
+ALTER TABLE balance_history ADD COLUMN IF NOT EXISTS id_wallet UUID REFERENCES wallets (id);
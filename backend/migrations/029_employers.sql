@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS employers (
+	id     UUID PRIMARY KEY,
+	name   TEXT NOT NULL,
+	cnpj   TEXT NOT NULL UNIQUE,
+	email  TEXT NOT NULL,
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	date   TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS employer_admins (
+	id          UUID PRIMARY KEY,
+	id_employer UUID NOT NULL REFERENCES employers (id),
+	name        TEXT NOT NULL,
+	email       TEXT NOT NULL UNIQUE,
+	password    TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS employer_employees (
+	id           UUID PRIMARY KEY,
+	id_employer  UUID NOT NULL REFERENCES employers (id),
+	id_user      UUID NOT NULL REFERENCES users (id),
+	registration TEXT,
+	active       BOOLEAN NOT NULL DEFAULT TRUE,
+	date         TEXT NOT NULL,
+	UNIQUE (id_employer, id_user)
+);
+
+CREATE TABLE IF NOT EXISTS employer_invoices (
+	id          UUID PRIMARY KEY,
+	id_employer UUID NOT NULL REFERENCES employers (id),
+	employees   INTEGER NOT NULL,
+	total       NUMERIC(12, 2) NOT NULL,
+	date        TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS employer_invoice_items (
+	id         UUID PRIMARY KEY,
+	id_invoice UUID NOT NULL REFERENCES employer_invoices (id),
+	id_user    UUID NOT NULL REFERENCES users (id),
+	value      NUMERIC(10, 2) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS employer_invoice_items_id_invoice_idx ON employer_invoice_items (id_invoice);
@@ -0,0 +1,29 @@
+-- A single row with id 1 holds the settings
+CREATE TABLE IF NOT EXISTS loyalty_settings (
+	id              INTEGER PRIMARY KEY CHECK (id = 1),
+	points_per_real NUMERIC(10, 2) NOT NULL,
+	redeem_points   INTEGER NOT NULL CHECK (redeem_points > 0),
+	redeem_value    NUMERIC(10, 2) NOT NULL,
+	expiry_days     INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS loyalty_points (
+	id         UUID PRIMARY KEY,
+	id_user    UUID NOT NULL REFERENCES users (id),
+	id_fare    UUID REFERENCES fares (id),
+	points     INTEGER NOT NULL,
+	remaining  INTEGER NOT NULL CHECK (remaining >= 0),
+	-- Empty when points do not expire
+	expires_at TEXT NOT NULL DEFAULT '',
+	date       TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS loyalty_points_id_user_idx ON loyalty_points (id_user);
+
+CREATE TABLE IF NOT EXISTS loyalty_redemptions (
+	id      UUID PRIMARY KEY,
+	id_user UUID NOT NULL REFERENCES users (id),
+	points  INTEGER NOT NULL,
+	value   NUMERIC(10, 2) NOT NULL,
+	date    TEXT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS date TEXT;
@@ -0,0 +1,3 @@
+-- ACTIVE, BLOCKED, LOST or REPLACED
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'ACTIVE';
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS replaced_by TEXT REFERENCES uids (uid) ON UPDATE CASCADE;
@@ -0,0 +1,22 @@
+-- Cards without a user carry their own balance
+ALTER TABLE uids ALTER COLUMN id_user DROP NOT NULL;
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS balance NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (balance >= 0);
+
+CREATE TABLE IF NOT EXISTS card_balance_history (
+	id          UUID PRIMARY KEY,
+	uid         TEXT NOT NULL REFERENCES uids (uid) ON UPDATE CASCADE,
+	old_balance NUMERIC(10, 2) NOT NULL,
+	balance     NUMERIC(10, 2) NOT NULL,
+	value       NUMERIC(10, 2) NOT NULL,
+	type        TEXT NOT NULL,
+	date        TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS card_balance_history_uid_idx ON card_balance_history (uid);
+
+ALTER TABLE fares ALTER COLUMN id_user DROP NOT NULL;
+ALTER TABLE fares ADD COLUMN IF NOT EXISTS uid TEXT;
+
+-- bcrypt hash of the code handed out with an anonymous card, required to claim
+-- its balance
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS claim_code TEXT;
@@ -0,0 +1,7 @@
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS label TEXT;
+-- Zero means no limit
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS daily_spend_limit NUMERIC(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE uids ADD COLUMN IF NOT EXISTS daily_ride_limit INTEGER NOT NULL DEFAULT 0;
+
+-- The value charged on each ride, which the daily spend limit adds up
+ALTER TABLE fares ADD COLUMN IF NOT EXISTS fare NUMERIC(10, 2) NOT NULL DEFAULT 0;
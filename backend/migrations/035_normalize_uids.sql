@@ -0,0 +1,15 @@
+-- UIDs are stored the way normalizeUID writes them: upper case hex without a
+-- 0X prefix or separators. UIDs stored as decimal numbers are left for the
+-- owners to link again, and so are UIDs whose normalized form is taken.
+UPDATE uids u
+SET uid = n.uid
+FROM (
+	SELECT uid AS old_uid, regexp_replace(regexp_replace(upper(trim(uid)), '^0X', ''), '[\s:-]', '', 'g') AS uid
+	FROM uids
+) n
+WHERE u.uid = n.old_uid
+	AND n.uid <> n.old_uid
+	AND n.uid <> ''
+	AND NOT EXISTS (SELECT 1 FROM uids x WHERE x.uid = n.uid);
+
+UPDATE fares SET uid = regexp_replace(regexp_replace(upper(trim(uid)), '^0X', ''), '[\s:-]', '', 'g') WHERE uid IS NOT NULL;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS fares_uid_id_bus_idx ON fares (uid, id_bus);
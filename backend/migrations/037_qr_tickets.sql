@@ -0,0 +1,7 @@
+-- Each signed QR code is accepted once
+CREATE TABLE IF NOT EXISTS qr_tickets (
+	jti     TEXT PRIMARY KEY,
+	id_user UUID NOT NULL REFERENCES users (id),
+	id_bus  UUID NOT NULL REFERENCES bus (id),
+	date    TEXT NOT NULL
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS card_inventory (
+	uid       TEXT PRIMARY KEY,
+	serial    TEXT NOT NULL UNIQUE,
+	batch     TEXT NOT NULL,
+	-- PRINTED, SHIPPED, SOLD or ACTIVATED
+	status    TEXT NOT NULL,
+	id_user   UUID REFERENCES users (id),
+	issued_at TEXT,
+	date      TEXT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE bus ADD COLUMN IF NOT EXISTS deleted_at TEXT;
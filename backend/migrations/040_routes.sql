@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS routes (
+	id        UUID PRIMARY KEY,
+	code      TEXT NOT NULL,
+	name      TEXT NOT NULL,
+	-- OUTBOUND, INBOUND or CIRCULAR
+	direction TEXT NOT NULL,
+	color     TEXT,
+	geometry  JSONB,
+	-- The fare of the buses on the route when set
+	fare      NUMERIC(10, 2),
+	active    BOOLEAN NOT NULL DEFAULT TRUE,
+	UNIQUE (code, direction)
+);
+
+ALTER TABLE bus ADD COLUMN IF NOT EXISTS id_route UUID REFERENCES routes (id);
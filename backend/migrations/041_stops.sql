@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS stops (
+	id                 UUID PRIMARY KEY,
+	code               TEXT UNIQUE,
+	name               TEXT NOT NULL,
+	lat                DOUBLE PRECISION NOT NULL,
+	lng                DOUBLE PRECISION NOT NULL,
+	wheelchair         BOOLEAN NOT NULL DEFAULT FALSE,
+	tactile_paving     BOOLEAN NOT NULL DEFAULT FALSE,
+	audio_announcement BOOLEAN NOT NULL DEFAULT FALSE,
+	active             BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS route_stops (
+	id_route UUID NOT NULL REFERENCES routes (id),
+	id_stop  UUID NOT NULL REFERENCES stops (id),
+	sequence INTEGER NOT NULL,
+	PRIMARY KEY (id_route, sequence)
+);
@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS agencies (
+	gtfs_id  TEXT PRIMARY KEY,
+	name     TEXT NOT NULL,
+	url      TEXT,
+	timezone TEXT,
+	lang     TEXT,
+	phone    TEXT
+);
+
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS gtfs_id TEXT;
+ALTER TABLE stops ADD COLUMN IF NOT EXISTS gtfs_id TEXT UNIQUE;
+
+CREATE TABLE IF NOT EXISTS service_calendars (
+	id         TEXT PRIMARY KEY,
+	monday     BOOLEAN NOT NULL DEFAULT FALSE,
+	tuesday    BOOLEAN NOT NULL DEFAULT FALSE,
+	wednesday  BOOLEAN NOT NULL DEFAULT FALSE,
+	thursday   BOOLEAN NOT NULL DEFAULT FALSE,
+	friday     BOOLEAN NOT NULL DEFAULT FALSE,
+	saturday   BOOLEAN NOT NULL DEFAULT FALSE,
+	sunday     BOOLEAN NOT NULL DEFAULT FALSE,
+	start_date TEXT NOT NULL,
+	end_date   TEXT NOT NULL
+);
+
+-- Trip ids are the GTFS trip_id strings on import and UUIDs when the trips
+-- are written through the API, so they are stored as text
+CREATE TABLE IF NOT EXISTS trips (
+	id         TEXT PRIMARY KEY,
+	id_route   UUID NOT NULL REFERENCES routes (id),
+	id_service TEXT REFERENCES service_calendars (id),
+	headsign   TEXT,
+	shape_id   TEXT
+);
+
+CREATE INDEX IF NOT EXISTS trips_id_route_idx ON trips (id_route);
+
+CREATE TABLE IF NOT EXISTS trip_stop_times (
+	id_trip        TEXT NOT NULL REFERENCES trips (id) ON DELETE CASCADE,
+	id_stop        UUID NOT NULL REFERENCES stops (id),
+	sequence       INTEGER NOT NULL,
+	arrival_time   TEXT,
+	departure_time TEXT,
+	PRIMARY KEY (id_trip, sequence)
+);
@@ -0,0 +1 @@
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS agency_gtfs_id TEXT REFERENCES agencies (gtfs_id);
@@ -0,0 +1,2 @@
+-- The realtime feed reads the latest position of each bus
+CREATE INDEX IF NOT EXISTS bus_stats_id_bus_idx ON bus_stats (id_bus);
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS drivers (
+	id           UUID PRIMARY KEY,
+	name         TEXT NOT NULL,
+	registration TEXT NOT NULL UNIQUE,
+	-- bcrypt hash of the PIN
+	pin          TEXT NOT NULL,
+	uid          TEXT UNIQUE,
+	active       BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS shifts (
+	id         UUID PRIMARY KEY,
+	id_driver  UUID NOT NULL REFERENCES drivers (id),
+	id_bus     UUID NOT NULL REFERENCES bus (id),
+	started_at TEXT NOT NULL,
+	ended_at   TEXT
+);
+
+-- A driver and a bus have one open shift at a time
+CREATE UNIQUE INDEX IF NOT EXISTS shifts_open_driver_idx ON shifts (id_driver) WHERE ended_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS shifts_open_bus_idx ON shifts (id_bus) WHERE ended_at IS NULL;
+
+ALTER TABLE fares ADD COLUMN IF NOT EXISTS id_shift UUID REFERENCES shifts (id);
+ALTER TABLE fares ADD COLUMN IF NOT EXISTS id_driver UUID REFERENCES drivers (id);
+ALTER TABLE bus_stats ADD COLUMN IF NOT EXISTS id_shift UUID REFERENCES shifts (id);
+ALTER TABLE bus_stats ADD COLUMN IF NOT EXISTS id_driver UUID REFERENCES drivers (id);
+
+-- SHA-256 of the token the validator of the bus authenticates with
+ALTER TABLE bus ADD COLUMN IF NOT EXISTS token TEXT UNIQUE;
@@ -0,0 +1,9 @@
+-- Counts reported by the onboard sensors
+CREATE TABLE IF NOT EXISTS bus_occupancy (
+	id     UUID PRIMARY KEY,
+	id_bus UUID NOT NULL REFERENCES bus (id),
+	count  INTEGER NOT NULL CHECK (count >= 0),
+	date   TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS bus_occupancy_id_bus_idx ON bus_occupancy (id_bus);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS zones (
+	id       UUID PRIMARY KEY,
+	code     TEXT NOT NULL UNIQUE,
+	name     TEXT NOT NULL,
+	geometry JSONB NOT NULL,
+	active   BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS zone_fares (
+	id_route     UUID NOT NULL REFERENCES routes (id),
+	id_zone_from UUID NOT NULL REFERENCES zones (id),
+	id_zone_to   UUID NOT NULL REFERENCES zones (id),
+	fare         NUMERIC(10, 2) NOT NULL,
+	PRIMARY KEY (id_route, id_zone_from, id_zone_to)
+);
@@ -0,0 +1,23 @@
+ALTER TABLE routes ADD COLUMN IF NOT EXISTS tap_out BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS journeys (
+	id           UUID PRIMARY KEY,
+	id_fare      UUID NOT NULL REFERENCES fares (id),
+	uid          TEXT NOT NULL,
+	id_user      UUID REFERENCES users (id),
+	id_bus       UUID NOT NULL REFERENCES bus (id),
+	id_route     UUID NOT NULL REFERENCES routes (id),
+	id_zone_from UUID REFERENCES zones (id),
+	id_zone_to   UUID REFERENCES zones (id),
+	-- Charged on tap in and refunded down to the fare on tap out
+	max_fare     NUMERIC(10, 2) NOT NULL,
+	fare         NUMERIC(10, 2),
+	-- The wallets the max fare was debited from, to refund them in order
+	debits       JSONB NOT NULL DEFAULT '[]',
+	-- OPEN, CLOSED or AUTO_CLOSED
+	status       TEXT NOT NULL,
+	started_at   TEXT NOT NULL,
+	ended_at     TEXT
+);
+
+CREATE INDEX IF NOT EXISTS journeys_uid_status_idx ON journeys (uid, status);
@@ -0,0 +1,12 @@
+-- Whether the service runs on the days listed in holidays
+ALTER TABLE service_calendars ADD COLUMN IF NOT EXISTS holidays BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS holidays (
+	date TEXT PRIMARY KEY,
+	name TEXT NOT NULL
+);
+
+-- The route the bus was running when it reported each position. Positions
+-- reported before this column existed take the route the bus has now.
+ALTER TABLE bus_stats ADD COLUMN IF NOT EXISTS id_route UUID REFERENCES routes (id);
+UPDATE bus_stats bs SET id_route = b.id_route FROM bus b WHERE b.id = bs.id_bus AND bs.id_route IS NULL;
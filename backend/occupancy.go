@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+// OccupancyLevel follows the OccupancyStatus values of GTFS-Realtime.
+type OccupancyLevel string
+
+const (
+	OccupancyEmpty           OccupancyLevel = "EMPTY"
+	OccupancyManySeats       OccupancyLevel = "MANY_SEATS_AVAILABLE"
+	OccupancyFewSeats        OccupancyLevel = "FEW_SEATS_AVAILABLE"
+	OccupancyStandingRoom    OccupancyLevel = "STANDING_ROOM_ONLY"
+	OccupancyCrushedStanding OccupancyLevel = "CRUSHED_STANDING_ROOM_ONLY"
+	OccupancyFull            OccupancyLevel = "FULL"
+)
+
+// Enum numbers of the OccupancyStatus levels in gtfs-realtime.proto
+var occupancyStatusNumber = map[OccupancyLevel]uint64{
+	OccupancyEmpty:           0,
+	OccupancyManySeats:       1,
+	OccupancyFewSeats:        2,
+	OccupancyStandingRoom:    3,
+	OccupancyCrushedStanding: 4,
+	OccupancyFull:            5,
+}
+
+// Sensor counts older than this are ignored and the estimate from boardings
+// is used instead.
+const occupancySensorMaxAge = 5 * time.Minute
+
+// Bus lists and realtime feeds reuse the estimate of every bus for this long
+// instead of counting the fares again on each request.
+const occupancyCacheTTL = 15 * time.Second
+
+type Occupancy struct {
+	Passengers int            `json:"passengers"`
+	Capacity   int            `json:"capacity"`
+	Percentage int            `json:"percentage"`
+	Level      OccupancyLevel `json:"level"`
+	Source     string         `json:"source"`
+}
+
+type OccupancyCount struct {
+	Count *int `json:"count" binding:"required,gte=0"`
+}
+
+// OccupancyModel estimates how many passengers are on board a bus. Without a
+// recent passenger counter reading, every boarding is assumed to stay on the
+// bus for the average ride duration, unless the card tapped out before. Cards
+// that have not tapped out yet stay on board past the ride duration.
+type OccupancyModel struct {
+	capacity     int
+	rideDuration time.Duration
+
+	mu       sync.Mutex
+	cached   map[string]Occupancy
+	cachedAt time.Time
+}
+
+func NewOccupancyModel(capacity int, rideDuration time.Duration) *OccupancyModel {
+	return &OccupancyModel{
+		capacity:     capacity,
+		rideDuration: rideDuration,
+	}
+}
+
+func (o *OccupancyModel) occupancy(passengers int, source string) Occupancy {
+	percentage := int(math.Round(float64(passengers) * 100 / float64(o.capacity)))
+
+	// Around 40% of the capacity of a city bus is seated
+	level := OccupancyFull
+	switch {
+	case passengers == 0:
+		level = OccupancyEmpty
+	case percentage < 25:
+		level = OccupancyManySeats
+	case percentage < 40:
+		level = OccupancyFewSeats
+	case percentage < 80:
+		level = OccupancyStandingRoom
+	case percentage < 100:
+		level = OccupancyCrushedStanding
+	}
+
+	return Occupancy{Passengers: passengers, Capacity: o.capacity, Percentage: percentage, Level: level, Source: source}
+}
+
+// Estimate returns the occupancy of every bus that is not deleted, keyed by
+// bus ID. The result is shared between callers and must not be changed.
+func (o *OccupancyModel) Estimate() (map[string]Occupancy, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.cached != nil && time.Since(o.cachedAt) < occupancyCacheTTL {
+		return o.cached, nil
+	}
+
+	occupancies, err := o.estimate("")
+	if err != nil {
+		return occupancies, err
+	}
+
+	o.cached = occupancies
+	o.cachedAt = time.Now()
+
+	return occupancies, nil
+}
+
+// EstimateBus returns the occupancy of a single bus, counting only its fares.
+func (o *OccupancyModel) EstimateBus(IdBus string) (Occupancy, error) {
+	occupancies, err := o.estimate(IdBus)
+	if err != nil {
+		return Occupancy{}, err
+	}
+
+	return occupancies[IdBus], nil
+}
+
+// Invalidate drops the cached estimate, so a new counter reading shows up
+// right away.
+func (o *OccupancyModel) Invalidate() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.cached = nil
+}
+
+// estimate counts the passengers of the bus, or of every bus when IdBus is
+// empty.
+func (o *OccupancyModel) estimate(IdBus string) (map[string]Occupancy, error) {
+	occupancies := make(map[string]Occupancy)
+
+	now := time.Now()
+
+	rows, err := db.Query("SELECT b.id, COALESCE(f.boardings, 0), COALESCE(bo.count, -1), COALESCE(bo.date, '') FROM bus b LEFT JOIN (SELECT id_bus, COUNT(*) AS boardings FROM (SELECT f.id_bus FROM fares f LEFT JOIN journeys j ON j.id_fare = f.id WHERE ($2 = '' OR f.id_bus = NULLIF($2, '')::uuid) AND f.date::timestamptz > $1 AND j.status IS DISTINCT FROM $3 UNION ALL SELECT id_bus FROM journeys WHERE ($2 = '' OR id_bus = NULLIF($2, '')::uuid) AND status = $4 AND started_at::timestamptz <= $1) on_board GROUP BY id_bus) f ON f.id_bus = b.id LEFT JOIN (SELECT DISTINCT ON (id_bus) id_bus, count, date FROM bus_occupancy WHERE ($2 = '' OR id_bus = NULLIF($2, '')::uuid) ORDER BY id_bus, date::timestamptz DESC) bo ON bo.id_bus = b.id WHERE b.deleted_at IS NULL AND ($2 = '' OR b.id = NULLIF($2, '')::uuid)", now.Add(-o.rideDuration), IdBus, JourneyClosed, JourneyOpen)
+	if err != nil {
+		return occupancies, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, date string
+		var boardings, count int
+		if err := rows.Scan(&id, &boardings, &count, &date); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if count >= 0 {
+			if countedAt, err := parseDateString(date); err == nil && now.Sub(countedAt) <= occupancySensorMaxAge {
+				occupancies[id] = o.occupancy(count, "sensor")
+				continue
+			}
+		}
+
+		occupancies[id] = o.occupancy(boardings, "fares")
+	}
+
+	return occupancies, rows.Err()
+}
+
+// createBusOccupancy records the passenger count reported by the automatic
+// passenger counter of a bus.
+func createBusOccupancy(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var count OccupancyCount
+
+	if err := c.ShouldBindJSON(&count); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM bus WHERE id = $1 AND deleted_at IS NULL)", id).Scan(&exists); err != nil {
+		log.Println(err)
+	}
+
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No bus found with ID: " + id})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	id_occupancy := uuid.New()
+
+	if _, err := db.Exec("INSERT INTO bus_occupancy (id, id_bus, count, date) VALUES ($1, $2, $3, $4)", id_occupancy, id, *count.Count, createDateString(time)); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create occupancy count"})
+		return
+	}
+
+	occupancyModel.Invalidate()
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Occupancy successfully created!", "id": id_occupancy, "occupancy": occupancyModel.occupancy(*count.Count, "sensor")})
+}
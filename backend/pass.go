@@ -0,0 +1,372 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type PassPeriod string
+
+const (
+	Weekly  PassPeriod = "WEEKLY"
+	Monthly PassPeriod = "MONTHLY"
+)
+
+type PassProduct struct {
+	ID     string     `json:"id,omitempty"`
+	Name   string     `json:"name" binding:"required,gte=4"`
+	Period PassPeriod `json:"period" binding:"required,oneof=WEEKLY MONTHLY"`
+	Price  float64    `json:"price" binding:"required,gt=0"`
+	Routes []string   `json:"routes"`
+	Active bool       `json:"active"`
+}
+
+type UserPass struct {
+	ID            string `json:"id,omitempty"`
+	IdUser        string `json:"id_user,omitempty"`
+	IdPassProduct string `json:"id_pass_product" binding:"required,uuid"`
+	Name          string `json:"name,omitempty"`
+	Period        string `json:"period,omitempty"`
+	StartsAt      string `json:"starts_at,omitempty"`
+	ExpiresAt     string `json:"expires_at,omitempty"`
+	Date          string `json:"date,omitempty"`
+}
+
+func (p PassPeriod) expiration(start time.Time) time.Time {
+	if p == Weekly {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// findActivePassUser returns the id of a pass owned by the user that is valid
+// right now for the given route, or an empty string when there is none.
+func findActivePassUser(IdUser string, route string) (string, error) {
+	rows, err := db.Query("SELECT up.id, up.starts_at, up.expires_at, pp.routes FROM user_passes up JOIN pass_products pp ON pp.id = up.id_pass_product WHERE up.id_user = $1", IdUser)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+
+	for rows.Next() {
+		var id, startsAt, expiresAt string
+		var routes []string
+
+		if err := rows.Scan(&id, &startsAt, &expiresAt, pq.Array(&routes)); err != nil {
+			return "", err
+		}
+
+		start, err := parseDateString(startsAt)
+		if err != nil {
+			continue
+		}
+		end, err := parseDateString(expiresAt)
+		if err != nil {
+			continue
+		}
+
+		if now.Before(start) || !now.Before(end) {
+			continue
+		}
+
+		if len(routes) == 0 {
+			return id, nil
+		}
+
+		for _, r := range routes {
+			if r == route {
+				return id, nil
+			}
+		}
+	}
+
+	return "", rows.Err()
+}
+
+func getPassProducts(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	query := "SELECT id, name, period, price, routes, active FROM pass_products WHERE active IS TRUE ORDER BY price"
+	if _, isAdmin := c.Get("admin"); isAdmin {
+		query = "SELECT id, name, period, price, routes, active FROM pass_products ORDER BY price"
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var products []PassProduct
+	for rows.Next() {
+		var p PassProduct
+		err := rows.Scan(&p.ID, &p.Name, &p.Period, &p.Price, pq.Array(&p.Routes), &p.Active)
+		if err != nil {
+			log.Println(err)
+		}
+		products = append(products, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, products)
+}
+
+func createPassProduct(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var product PassProduct
+
+	if err := c.ShouldBindJSON(&product); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if product.Routes == nil {
+		product.Routes = []string{}
+	}
+
+	stmt, err := db.Prepare("INSERT INTO pass_products (id, name, period, price, routes, active) VALUES ($1, $2, $3, $4, $5, TRUE)")
+	if err != nil {
+		log.Println(err)
+	}
+	defer stmt.Close()
+
+	id_pass_product := uuid.New()
+
+	if _, err := stmt.Exec(id_pass_product, product.Name, product.Period, product.Price, pq.Array(product.Routes)); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Pass product successfully created!", "id": id_pass_product})
+}
+
+func deactivatePassProduct(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE pass_products SET active = FALSE WHERE id = $1", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Pass product successfully deactivated!"})
+}
+
+func getPassesByUser(c *gin.Context) {
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	rows, err := db.Query("SELECT up.id, up.id_user, up.id_pass_product, pp.name, pp.period, up.starts_at, up.expires_at, up.date FROM user_passes up JOIN pass_products pp ON pp.id = up.id_pass_product WHERE up.id_user = $1 ORDER BY up.date DESC;", IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var passes []UserPass
+
+	for rows.Next() {
+		var p UserPass
+		err := rows.Scan(&p.ID, &p.IdUser, &p.IdPassProduct, &p.Name, &p.Period, &p.StartsAt, &p.ExpiresAt, &p.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		passes = append(passes, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, passes)
+}
+
+func purchasePassUser(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var userPass UserPass
+
+	if err := c.ShouldBindJSON(&userPass); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	var product PassProduct
+	row_product := db.QueryRow("SELECT id, name, period, price FROM pass_products WHERE id = $1 AND active IS TRUE", userPass.IdPassProduct)
+
+	err_product := row_product.Scan(&product.ID, &product.Name, &product.Period, &product.Price)
+
+	if err_product != nil {
+		if err_product == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + userPass.IdPassProduct})
+			return
+		} else {
+			log.Println(err_product)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot purchase pass"})
+		return
+	}
+	defer tx.Rollback()
+
+	wallet, err := ensureWalletUserTx(tx, IdUserToken, PersonalWallet)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + IdUserToken})
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot purchase pass"})
+		}
+		return
+	}
+
+	// Locking the wallet serializes the purchases of the user, so two requests
+	// cannot both renew from the same expiration date
+	if err := tx.QueryRow("SELECT balance FROM wallets WHERE id = $1 FOR UPDATE", wallet.ID).Scan(&wallet.Balance); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot purchase pass"})
+		return
+	}
+
+	// Vale-transporte credit only pays for fares, passes come out of the personal wallet
+	if (wallet.Balance - product.Price) < 0 {
+		c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", wallet.Balance)})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	startsAt := time.Now().In(loc)
+
+	// Buying the same product again renews it from the end of the current one
+	rows, err := tx.Query("SELECT expires_at FROM user_passes WHERE id_user = $1 AND id_pass_product = $2", IdUserToken, product.ID)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot purchase pass"})
+		return
+	}
+
+	for rows.Next() {
+		var expiresAt string
+		if err := rows.Scan(&expiresAt); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if last, err := parseDateString(expiresAt); err == nil && last.After(startsAt) {
+			startsAt = last.In(loc)
+		}
+	}
+	rows.Close()
+
+	expiresAt := product.Period.expiration(startsAt)
+
+	balance, err := creditWalletUserTx(tx, IdUserToken, PersonalWallet, -product.Price, PassPurchase)
+	if err != nil {
+		if err == ErrInsufficientBalance {
+			c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": "Saldo insuficiente, Saldo: R$ " + fmt.Sprintf("%.2f", wallet.Balance)})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot purchase pass"})
+		return
+	}
+
+	id_user_pass := uuid.New()
+	time := time.Now().In(loc)
+
+	if _, err := tx.Exec("INSERT INTO user_passes (id, id_user, id_pass_product, starts_at, expires_at, date) VALUES ($1, $2, $3, $4, $5, $6)", id_user_pass, IdUserToken, product.ID, createDateString(startsAt), createDateString(expiresAt), createDateString(time)); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot purchase pass"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot purchase pass"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Passe adquirido com sucesso!", "id": id_user_pass, "starts_at": createDateString(startsAt), "expires_at": createDateString(expiresAt), "balance": balance})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// AntiPassback keeps the last accepted tap of each card on each bus so a card
+// held against the reader is not charged again inside the window.
+type AntiPassback struct {
+	taps   map[string]time.Time
+	mu     sync.Mutex
+	window time.Duration
+}
+
+func NewAntiPassback(window time.Duration) *AntiPassback {
+	return &AntiPassback{
+		taps:   make(map[string]time.Time),
+		window: window,
+	}
+}
+
+// Reserve records a tap and reports whether it is allowed. Taps that end up
+// not being charged must be given back with Release.
+func (a *AntiPassback) Reserve(uid string, idBus string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := idBus + "|" + uid
+	now := time.Now()
+
+	if last, ok := a.taps[key]; ok && now.Sub(last) < a.window {
+		return false
+	}
+
+	a.taps[key] = now
+
+	// Drop old entries so the map does not grow forever
+	for k, t := range a.taps {
+		if now.Sub(t) >= a.window {
+			delete(a.taps, k)
+		}
+	}
+
+	return true
+}
+
+func (a *AntiPassback) Release(uid string, idBus string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.taps, idBus+"|"+uid)
+}
+
+// recentFareExists covers taps charged before a restart or by another instance.
+func (a *AntiPassback) recentFareExists(uid string, idBus string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM fares WHERE uid = $1 AND id_bus = $2 AND date::timestamptz > $3)", uid, idBus, time.Now().Add(-a.window)).Scan(&exists)
+	return exists, err
+}
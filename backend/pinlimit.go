@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// PinLimiter counts the wrong driver PINs typed on each bus and for each
+// registration, so PINs cannot be found by trying them all on a validator.
+type PinLimiter struct {
+	failures    map[string][]time.Time
+	mu          sync.Mutex
+	maxAttempts int
+	window      time.Duration
+}
+
+func NewPinLimiter(maxAttempts int, window time.Duration) *PinLimiter {
+	return &PinLimiter{
+		failures:    make(map[string][]time.Time),
+		maxAttempts: maxAttempts,
+		window:      window,
+	}
+}
+
+// recent drops the failures of the key that are out of the window. The caller
+// must hold the lock.
+func (p *PinLimiter) recent(key string, now time.Time) []time.Time {
+	var kept []time.Time
+	for _, t := range p.failures[key] {
+		if now.Sub(t) < p.window {
+			kept = append(kept, t)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(p.failures, key)
+	} else {
+		p.failures[key] = kept
+	}
+
+	return kept
+}
+
+// Allow reports whether a PIN may be tried for the registration on the bus.
+func (p *PinLimiter) Allow(registration string, idBus string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	return len(p.recent("registration|"+registration, now)) < p.maxAttempts && len(p.recent("bus|"+idBus, now)) < p.maxAttempts
+}
+
+func (p *PinLimiter) Fail(registration string, idBus string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	for _, key := range []string{"registration|" + registration, "bus|" + idBus} {
+		p.failures[key] = append(p.recent(key, now), now)
+	}
+}
+
+// Reset clears the failures of the registration once the right PIN is typed.
+func (p *PinLimiter) Reset(registration string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.failures, "registration|"+registration)
+}
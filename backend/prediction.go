@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// Speed used when the recent positions of a bus are not enough to tell
+	// how fast it is moving, around 18 km/h in city traffic.
+	predictionDefaultSpeed = 5.0
+	predictionMinSpeed     = 1.5
+	predictionMaxSpeed     = 22.0
+	// Window of positions used to estimate the speed of a bus
+	predictionSpeedWindow = 5 * time.Minute
+	// Buses further than this from their route are not predicted
+	predictionMaxOffset = 300.0
+)
+
+type ArrivalPrediction struct {
+	IdBus      string  `json:"id_bus"`
+	Bus        string  `json:"bus"`
+	IdRoute    string  `json:"id_route"`
+	Route      string  `json:"route"`
+	RouteColor string  `json:"route_color"`
+	IdStop     string  `json:"id_stop"`
+	Sequence   int     `json:"sequence"`
+	Distance   float64 `json:"distance"`
+	Eta        int     `json:"eta"`
+	ArrivalAt  string  `json:"arrival_at"`
+}
+
+// projectOnLine finds the point of the polyline closest to p and returns how
+// far along the line it is and how far p is from it, both in meters. Points
+// are flattened around p, which is precise enough at city scale.
+func projectOnLine(line []Point, p Point) (float64, float64) {
+	return projectOnLineFrom(line, p, 0)
+}
+
+// projectOnLineFrom is projectOnLine limited to the part of the line at least
+// from meters along it.
+func projectOnLineFrom(line []Point, p Point, from float64) (float64, float64) {
+	cosLat := math.Cos(p.Lat * math.Pi / 180)
+	toXY := func(q Point) (float64, float64) {
+		return (q.Lng - p.Lng) * cosLat * 111320, (q.Lat - p.Lat) * 110540
+	}
+
+	best := math.Inf(1)
+	along := 0.0
+	travelled := 0.0
+
+	for i := 0; i+1 < len(line); i++ {
+		ax, ay := toXY(line[i])
+		bx, by := toXY(line[i+1])
+		dx, dy := bx-ax, by-ay
+		length := math.Hypot(dx, dy)
+
+		if travelled+length < from {
+			travelled += length
+			continue
+		}
+
+		t, minT := 0.0, 0.0
+		if length > 0 {
+			minT = math.Max(0, (from-travelled)/length)
+			t = math.Max(minT, math.Min(1, -(ax*dx+ay*dy)/(length*length)))
+		}
+
+		offset := math.Hypot(ax+t*dx, ay+t*dy)
+		if offset < best {
+			best = offset
+			along = travelled + t*length
+		}
+
+		travelled += length
+	}
+
+	return along, best
+}
+
+type busProgressEntry struct {
+	IdRoute    string
+	Along      float64
+	ReportedAt time.Time
+}
+
+// BusProgress keeps the last along-route position of each bus, so a position
+// near a loop or a parallel street does not send the bus back on its route.
+type BusProgress struct {
+	positions map[string]busProgressEntry
+	mu        sync.Mutex
+}
+
+func NewBusProgress() *BusProgress {
+	return &BusProgress{positions: make(map[string]busProgressEntry)}
+}
+
+// Get returns the last along-route position of the bus on the route, if it
+// was recorded recently enough to still hold.
+func (b *BusProgress) Get(IdBus string, IdRoute string) (float64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.positions[IdBus]
+	if !ok || entry.IdRoute != IdRoute || time.Since(entry.ReportedAt) > realtimeMaxAge {
+		return 0, false
+	}
+
+	return entry.Along, true
+}
+
+// Set records the along-route position of the bus unless a newer one is there.
+func (b *BusProgress) Set(IdBus string, IdRoute string, along float64, reportedAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if entry, ok := b.positions[IdBus]; ok && entry.IdRoute == IdRoute && entry.ReportedAt.After(reportedAt) {
+		return
+	}
+
+	b.positions[IdBus] = busProgressEntry{IdRoute: IdRoute, Along: along, ReportedAt: reportedAt}
+}
+
+// getBusSpeed estimates the speed of a bus in m/s from its recent positions.
+func getBusSpeed(IdBus string) float64 {
+	rows, err := db.Query("SELECT lat, lng, date FROM bus_stats WHERE id_bus = $1 AND date::timestamptz > $2 ORDER BY date::timestamptz", IdBus, time.Now().Add(-predictionSpeedWindow))
+	if err != nil {
+		log.Println(err)
+		return predictionDefaultSpeed
+	}
+	defer rows.Close()
+
+	var distance float64
+	var first, last time.Time
+	var prev *Point
+
+	for rows.Next() {
+		var p Point
+		var date string
+		if err := rows.Scan(&p.Lat, &p.Lng, &date); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		reportedAt, err := parseDateString(date)
+		if err != nil {
+			continue
+		}
+
+		if prev == nil {
+			first = reportedAt
+		} else {
+			distance += distanceMeters(*prev, p)
+		}
+		last = reportedAt
+		prev = &p
+	}
+
+	elapsed := last.Sub(first).Seconds()
+	if elapsed <= 0 {
+		return predictionDefaultSpeed
+	}
+
+	speed := distance / elapsed
+	if speed < predictionMinSpeed || speed > predictionMaxSpeed {
+		return predictionDefaultSpeed
+	}
+
+	return speed
+}
+
+// predictBusArrivals estimates when the bus reaches each stop still ahead of
+// it on its route, following the route geometry when there is one and the
+// stop sequence otherwise.
+func predictBusArrivals(IdBus string) ([]ArrivalPrediction, error) {
+	var bus ArrivalPrediction
+	var position Point
+	var geometryJSON []byte
+	var date string
+
+	row := db.QueryRow("SELECT b.id, b.name, r.id, r.code, r.color, r.geometry, bs.lat, bs.lng, bs.date FROM bus b JOIN routes r ON r.id = b.id_route AND r.active IS TRUE INNER JOIN (SELECT DISTINCT ON (id_bus) * FROM bus_stats WHERE id_bus = $1 ORDER BY id_bus, date::timestamptz DESC) bs ON b.id = bs.id_bus WHERE b.id = $1 AND b.active IS TRUE AND b.deleted_at IS NULL", IdBus)
+
+	if err := row.Scan(&bus.IdBus, &bus.Bus, &bus.IdRoute, &bus.Route, &bus.RouteColor, &geometryJSON, &position.Lat, &position.Lng, &date); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	reportedAt, err := parseDateString(date)
+	if err != nil || time.Since(reportedAt) > realtimeMaxAge {
+		return nil, nil
+	}
+
+	stops, err := getRouteStops(bus.IdRoute)
+	if err != nil {
+		return nil, err
+	}
+	if len(stops) < 2 {
+		return nil, nil
+	}
+
+	var line []Point
+	if len(geometryJSON) > 0 {
+		if err := json.Unmarshal(geometryJSON, &line); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Along-route distance of each stop. Stops are projected after the
+	// previous one so loops and parallel streets keep their order.
+	alongStops := make([]float64, len(stops))
+	if len(line) >= 2 {
+		for i, s := range stops {
+			alongStops[i], _ = projectOnLine(line, s.Point())
+			if i > 0 && alongStops[i] < alongStops[i-1] {
+				alongStops[i] = alongStops[i-1] + distanceMeters(stops[i-1].Point(), s.Point())
+			}
+		}
+	} else {
+		line = Map(stops, func(s RouteStop) Point { return s.Point() })
+		for i, s := range stops {
+			alongStops[i] = s.Distance
+		}
+	}
+
+	// Buses only move forward on their route. When the bus is no longer near
+	// the rest of the route it has started it again.
+	alongBus, offset := projectOnLine(line, position)
+	if last, ok := busProgress.Get(IdBus, bus.IdRoute); ok {
+		if alongAhead, offsetAhead := projectOnLineFrom(line, position, last); offsetAhead <= predictionMaxOffset {
+			alongBus, offset = alongAhead, offsetAhead
+		}
+	}
+	if offset > predictionMaxOffset {
+		return nil, nil
+	}
+	busProgress.Set(IdBus, bus.IdRoute, alongBus, reportedAt)
+
+	speed := getBusSpeed(IdBus)
+
+	// The bus kept moving since it reported its position
+	elapsed := time.Since(reportedAt).Seconds()
+	now := time.Now().In(reportedAt.Location())
+
+	var predictions []ArrivalPrediction
+	for i, s := range stops {
+		remaining := alongStops[i] - alongBus
+		if remaining < 0 {
+			continue
+		}
+
+		eta := int(math.Round(remaining/speed - elapsed))
+		if eta < 0 {
+			continue
+		}
+
+		p := bus
+		p.IdStop = s.ID
+		p.Sequence = s.Sequence
+		p.Distance = math.Round(remaining)
+		p.Eta = eta
+		p.ArrivalAt = createDateString(now.Add(time.Duration(eta) * time.Second))
+		predictions = append(predictions, p)
+	}
+
+	return predictions, nil
+}
+
+// pushBusPredictions sends the new arrival predictions of a bus to the clients
+// listening on each stop it is heading to.
+func pushBusPredictions(IdBus string) {
+	predictions, err := predictBusArrivals(IdBus)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, p := range predictions {
+		hub.BroadcastToID(p.IdStop, gin.H{"type": "prediction", "prediction": p})
+	}
+}
+
+func getArrivalsByStop(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	rows, err := db.Query("SELECT DISTINCT b.id FROM route_stops rs JOIN bus b ON b.id_route = rs.id_route WHERE rs.id_stop = $1 AND b.active IS TRUE AND b.deleted_at IS NULL", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot get arrivals for stop with ID: " + id})
+		return
+	}
+
+	var buses []string
+	for rows.Next() {
+		var IdBus string
+		if err := rows.Scan(&IdBus); err != nil {
+			log.Println(err)
+			continue
+		}
+		buses = append(buses, IdBus)
+	}
+	rows.Close()
+
+	arrivals := []ArrivalPrediction{}
+	for _, IdBus := range buses {
+		predictions, err := predictBusArrivals(IdBus)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		// A loop route can pass the same stop twice, the first pass is next
+		for _, p := range predictions {
+			if p.IdStop == id {
+				arrivals = append(arrivals, p)
+				break
+			}
+		}
+	}
+
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].Eta < arrivals[j].Eta })
+
+	c.IndentedJSON(http.StatusOK, arrivals)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const qrTicketTTL = 60 * time.Second
+
+func createQRTicket(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	expiresAt := time.Now().Add(qrTicketTTL).In(loc)
+
+	ticket, err := createQRTicketToken(IdUserToken, uuid.New().String(), expiresAt)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create ticket"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"qr": ticket, "expires_at": createDateString(expiresAt)})
+}
+
+// createQRFare validates a QR ticket shown at the validator and charges the
+// ride to its owner. A ticket is burned on first use, even if the fare fails.
+func createQRFare(c *gin.Context, bus Bus, qr string) {
+	IdUser, jti, err := getQRTicketClaims(qr)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TICKET_EXPIRED", "message": "QR Code expirado, gere um novo no aplicativo"}})
+			c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "QR ticket expired"})
+			return
+		}
+		hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "INVALID_TICKET", "message": "QR Code inválido"}})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid QR ticket", "errors": err.Error()})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	if _, err := db.Exec("INSERT INTO qr_tickets (jti, id_user, id_bus, date) VALUES ($1, $2, $3, $4)", jti, IdUser, bus.ID, createDateString(time)); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "TICKET_ALREADY_USED", "message": "QR Code já utilizado"}})
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "QR ticket already used"})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot validate QR ticket"})
+		return
+	}
+
+	var user User
+	row_user := db.QueryRow("SELECT id, image, name, surname FROM users WHERE id = $1", IdUser)
+
+	err_user := row_user.Scan(&user.ID, &user.Image, &user.Name, &user.Surname)
+
+	if err_user != nil {
+		if err_user == sql.ErrNoRows {
+			hub.BroadcastToID(bus.ID, gin.H{"type": "error", "error": gin.H{"type": "USER_NOT_FOUND", "message": "Nenhum usuário encontrado com este QR Code"}})
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + IdUser})
+			return
+		} else {
+			log.Println(err_user)
+		}
+	}
+
+	chargeFareUser(c, bus, user, Uid{})
+}
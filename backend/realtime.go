@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Positions older than this are left out of the realtime feed so planners do
+// not show buses that stopped reporting.
+const realtimeMaxAge = 30 * time.Minute
+
+type RealtimeTrip struct {
+	RouteID     string `json:"route_id,omitempty"`
+	DirectionID uint32 `json:"direction_id"`
+}
+
+type RealtimeVehicle struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+type RealtimePosition struct {
+	Latitude  float32 `json:"latitude"`
+	Longitude float32 `json:"longitude"`
+}
+
+type RealtimeVehiclePosition struct {
+	Trip                *RealtimeTrip    `json:"trip,omitempty"`
+	Vehicle             RealtimeVehicle  `json:"vehicle"`
+	Position            RealtimePosition `json:"position"`
+	Timestamp           uint64           `json:"timestamp"`
+	OccupancyStatus     OccupancyLevel   `json:"occupancy_status,omitempty"`
+	OccupancyPercentage uint32           `json:"occupancy_percentage,omitempty"`
+}
+
+type RealtimeEntity struct {
+	ID      string                  `json:"id"`
+	Vehicle RealtimeVehiclePosition `json:"vehicle"`
+}
+
+type RealtimeHeader struct {
+	GtfsRealtimeVersion string `json:"gtfs_realtime_version"`
+	Incrementality      string `json:"incrementality"`
+	Timestamp           uint64 `json:"timestamp"`
+}
+
+type RealtimeFeed struct {
+	Header RealtimeHeader   `json:"header"`
+	Entity []RealtimeEntity `json:"entity"`
+}
+
+// getVehiclePositions builds the feed from the last position reported by each
+// active bus. Route ids match the route_id of the static feed.
+func getVehiclePositions() (RealtimeFeed, error) {
+	feed := RealtimeFeed{
+		Header: RealtimeHeader{GtfsRealtimeVersion: "2.0", Incrementality: "FULL_DATASET", Timestamp: uint64(time.Now().Unix())},
+		Entity: []RealtimeEntity{},
+	}
+
+	rows, err := db.Query("SELECT b.id, b.name, COALESCE(r.code, ''), COALESCE(r.direction, ''), bs.lat, bs.lng, bs.date FROM bus b LEFT JOIN routes r ON r.id = b.id_route AND r.active IS TRUE INNER JOIN (SELECT DISTINCT ON (id_bus) * FROM bus_stats ORDER BY id_bus, date::timestamptz DESC) bs ON b.id = bs.id_bus WHERE b.active IS TRUE AND b.deleted_at IS NULL AND bs.date::timestamptz > $1", time.Now().Add(-realtimeMaxAge))
+	if err != nil {
+		return feed, err
+	}
+	defer rows.Close()
+
+	occupancies, err := occupancyModel.Estimate()
+	if err != nil {
+		log.Println(err)
+	}
+
+	for rows.Next() {
+		var id, name, code, direction, date string
+		var lat, lng float64
+		if err := rows.Scan(&id, &name, &code, &direction, &lat, &lng, &date); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		position := RealtimeVehiclePosition{
+			Vehicle:  RealtimeVehicle{ID: id, Label: name},
+			Position: RealtimePosition{Latitude: float32(lat), Longitude: float32(lng)},
+		}
+
+		if reportedAt, err := parseDateString(date); err == nil {
+			position.Timestamp = uint64(reportedAt.Unix())
+		}
+
+		if occupancy, ok := occupancies[id]; ok {
+			position.OccupancyStatus = occupancy.Level
+			position.OccupancyPercentage = uint32(occupancy.Percentage)
+		}
+
+		if code != "" {
+			position.Trip = &RealtimeTrip{RouteID: code}
+			if RouteDirection(direction) == RouteInbound {
+				position.Trip.DirectionID = 1
+			}
+		}
+
+		feed.Entity = append(feed.Entity, RealtimeEntity{ID: id, Vehicle: position})
+	}
+
+	return feed, rows.Err()
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func appendString(b []byte, num protowire.Number, value string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendVarint(b []byte, num protowire.Number, value uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendFloat(b []byte, num protowire.Number, value float32) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(value))
+}
+
+// Marshal encodes the feed as a gtfs-realtime.proto FeedMessage.
+func (f RealtimeFeed) Marshal() []byte {
+	var header []byte
+	header = appendString(header, 1, f.Header.GtfsRealtimeVersion)
+	header = appendVarint(header, 2, 0) // FULL_DATASET
+	header = appendVarint(header, 3, f.Header.Timestamp)
+
+	var b []byte
+	b = appendMessage(b, 1, header)
+
+	for _, e := range f.Entity {
+		var vehicle []byte
+
+		if e.Vehicle.Trip != nil {
+			var trip []byte
+			trip = appendString(trip, 5, e.Vehicle.Trip.RouteID)
+			trip = appendVarint(trip, 6, uint64(e.Vehicle.Trip.DirectionID))
+			vehicle = appendMessage(vehicle, 1, trip)
+		}
+
+		var position []byte
+		position = appendFloat(position, 1, e.Vehicle.Position.Latitude)
+		position = appendFloat(position, 2, e.Vehicle.Position.Longitude)
+		vehicle = appendMessage(vehicle, 2, position)
+
+		if e.Vehicle.Timestamp > 0 {
+			vehicle = appendVarint(vehicle, 5, e.Vehicle.Timestamp)
+		}
+
+		if e.Vehicle.OccupancyStatus != "" {
+			vehicle = appendVarint(vehicle, 9, occupancyStatusNumber[e.Vehicle.OccupancyStatus])
+			vehicle = appendVarint(vehicle, 10, uint64(e.Vehicle.OccupancyPercentage))
+		}
+
+		var descriptor []byte
+		descriptor = appendString(descriptor, 1, e.Vehicle.Vehicle.ID)
+		descriptor = appendString(descriptor, 2, e.Vehicle.Vehicle.Label)
+		vehicle = appendMessage(vehicle, 8, descriptor)
+
+		var entity []byte
+		entity = appendString(entity, 1, e.ID)
+		entity = appendMessage(entity, 4, vehicle)
+
+		b = appendMessage(b, 2, entity)
+	}
+
+	return b
+}
+
+func getVehiclePositionsFeed(c *gin.Context) {
+	feed, err := getVehiclePositions()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot generate vehicle positions feed"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/x-protobuf", feed.Marshal())
+}
+
+func getVehiclePositionsJSON(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	feed, err := getVehiclePositions()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot generate vehicle positions feed"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, feed)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type wireField struct {
+	Type  protowire.Type
+	Value uint64
+	Bytes []byte
+}
+
+// decodeFields reads one level of a protobuf message, keyed by field number.
+func decodeFields(t *testing.T, b []byte) map[protowire.Number][]wireField {
+	t.Helper()
+
+	fields := make(map[protowire.Number][]wireField)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		field := wireField{Type: typ}
+		switch typ {
+		case protowire.VarintType:
+			field.Value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			field.Value = uint64(v)
+		case protowire.BytesType:
+			field.Bytes, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", num, typ)
+		}
+		if n < 0 {
+			t.Fatalf("field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		fields[num] = append(fields[num], field)
+	}
+
+	return fields
+}
+
+// one returns the only field with the number and wire type.
+func one(t *testing.T, fields map[protowire.Number][]wireField, num protowire.Number, typ protowire.Type) wireField {
+	t.Helper()
+
+	if len(fields[num]) != 1 {
+		t.Fatalf("field %d: got %d values, want 1", num, len(fields[num]))
+	}
+	if fields[num][0].Type != typ {
+		t.Fatalf("field %d: got wire type %d, want %d", num, fields[num][0].Type, typ)
+	}
+
+	return fields[num][0]
+}
+
+func TestRealtimeFeedMarshal(t *testing.T) {
+	feed := RealtimeFeed{
+		Header: RealtimeHeader{GtfsRealtimeVersion: "2.0", Incrementality: "FULL_DATASET", Timestamp: 1700000000},
+		Entity: []RealtimeEntity{{
+			ID: "bus-1",
+			Vehicle: RealtimeVehiclePosition{
+				Trip:      &RealtimeTrip{RouteID: "101", DirectionID: 1},
+				Vehicle:   RealtimeVehicle{ID: "bus-1", Label: "Ônibus 1"},
+				Position:  RealtimePosition{Latitude: -23.5505, Longitude: -46.6333},
+				Timestamp: 1699999990,
+			},
+		}},
+	}
+
+	message := decodeFields(t, feed.Marshal())
+
+	// FeedHeader: gtfs_realtime_version = 1, incrementality = 2, timestamp = 3
+	header := decodeFields(t, one(t, message, 1, protowire.BytesType).Bytes)
+	if got := string(one(t, header, 1, protowire.BytesType).Bytes); got != "2.0" {
+		t.Errorf("gtfs_realtime_version: got %q, want %q", got, "2.0")
+	}
+	if got := one(t, header, 2, protowire.VarintType).Value; got != 0 {
+		t.Errorf("incrementality: got %d, want 0 (FULL_DATASET)", got)
+	}
+	if got := one(t, header, 3, protowire.VarintType).Value; got != 1700000000 {
+		t.Errorf("header timestamp: got %d, want 1700000000", got)
+	}
+
+	// FeedEntity: id = 1, vehicle = 4
+	entity := decodeFields(t, one(t, message, 2, protowire.BytesType).Bytes)
+	if got := string(one(t, entity, 1, protowire.BytesType).Bytes); got != "bus-1" {
+		t.Errorf("entity id: got %q, want %q", got, "bus-1")
+	}
+	vehicle := decodeFields(t, one(t, entity, 4, protowire.BytesType).Bytes)
+
+	// TripDescriptor: route_id = 5, direction_id = 6
+	trip := decodeFields(t, one(t, vehicle, 1, protowire.BytesType).Bytes)
+	if got := string(one(t, trip, 5, protowire.BytesType).Bytes); got != "101" {
+		t.Errorf("route_id: got %q, want %q", got, "101")
+	}
+	if got := one(t, trip, 6, protowire.VarintType).Value; got != 1 {
+		t.Errorf("direction_id: got %d, want 1", got)
+	}
+
+	// Position: latitude = 1, longitude = 2, both float
+	position := decodeFields(t, one(t, vehicle, 2, protowire.BytesType).Bytes)
+	if got := math.Float32frombits(uint32(one(t, position, 1, protowire.Fixed32Type).Value)); got != float32(-23.5505) {
+		t.Errorf("latitude: got %v, want %v", got, float32(-23.5505))
+	}
+	if got := math.Float32frombits(uint32(one(t, position, 2, protowire.Fixed32Type).Value)); got != float32(-46.6333) {
+		t.Errorf("longitude: got %v, want %v", got, float32(-46.6333))
+	}
+
+	// VehiclePosition: timestamp = 5
+	if got := one(t, vehicle, 5, protowire.VarintType).Value; got != 1699999990 {
+		t.Errorf("vehicle timestamp: got %d, want 1699999990", got)
+	}
+
+	// VehicleDescriptor: id = 1, label = 2
+	descriptor := decodeFields(t, one(t, vehicle, 8, protowire.BytesType).Bytes)
+	if got := string(one(t, descriptor, 1, protowire.BytesType).Bytes); got != "bus-1" {
+		t.Errorf("vehicle id: got %q, want %q", got, "bus-1")
+	}
+	if got := string(one(t, descriptor, 2, protowire.BytesType).Bytes); got != "Ônibus 1" {
+		t.Errorf("vehicle label: got %q, want %q", got, "Ônibus 1")
+	}
+
+	// No occupancy is sent when it is unknown
+	if len(vehicle[9]) != 0 {
+		t.Errorf("occupancy_status: got %d values, want none", len(vehicle[9]))
+	}
+}
+
+func TestRealtimeFeedMarshalOccupancy(t *testing.T) {
+	feed := RealtimeFeed{
+		Entity: []RealtimeEntity{{
+			ID: "bus-1",
+			Vehicle: RealtimeVehiclePosition{
+				Vehicle:             RealtimeVehicle{ID: "bus-1", Label: "Ônibus 1"},
+				OccupancyStatus:     OccupancyStandingRoom,
+				OccupancyPercentage: 85,
+			},
+		}},
+	}
+
+	message := decodeFields(t, feed.Marshal())
+	entity := decodeFields(t, one(t, message, 2, protowire.BytesType).Bytes)
+	vehicle := decodeFields(t, one(t, entity, 4, protowire.BytesType).Bytes)
+
+	// VehiclePosition: occupancy_status = 9, occupancy_percentage = 10
+	if got := one(t, vehicle, 9, protowire.VarintType).Value; got != occupancyStatusNumber[OccupancyStandingRoom] {
+		t.Errorf("occupancy_status: got %d, want %d", got, occupancyStatusNumber[OccupancyStandingRoom])
+	}
+	if got := one(t, vehicle, 10, protowire.VarintType).Value; got != 85 {
+		t.Errorf("occupancy_percentage: got %d, want 85", got)
+	}
+}
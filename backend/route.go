@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type RouteDirection string
+
+const (
+	RouteInbound  RouteDirection = "INBOUND"
+	RouteOutbound RouteDirection = "OUTBOUND"
+	RouteCircular RouteDirection = "CIRCULAR"
+)
+
+type Point struct {
+	Lat float64 `json:"lat" binding:"gte=-90,lte=90"`
+	Lng float64 `json:"lng" binding:"gte=-180,lte=180"`
+}
+
+type Route struct {
+	ID        string         `json:"id,omitempty"`
+	Code      string         `json:"code" binding:"required,lte=20"`
+	Name      string         `json:"name" binding:"required,lte=100"`
+	Direction RouteDirection `json:"direction" binding:"required,oneof=INBOUND OUTBOUND CIRCULAR"`
+	Color     string         `json:"color" binding:"required,hexcolor"`
+	Geometry  []Point        `json:"geometry" binding:"omitempty,dive"`
+	Fare      *float64       `json:"fare,omitempty" binding:"omitempty,gt=0"`
+	TapOut    bool           `json:"tap_out"`
+	Active    bool           `json:"active"`
+	Buses     []BusAndStats  `json:"buses,omitempty"`
+}
+
+// busFareQuery resolves the fare charged on a bus: the fare of its route when
+// the route sets one, the bus fare otherwise.
+const busFareQuery = "SELECT COALESCE(r.fare, b.fare) FROM bus b LEFT JOIN routes r ON r.id = b.id_route AND r.active IS TRUE WHERE b.id = $1"
+
+func getBusFare(IdBus string) (float64, error) {
+	var fare float64
+	err := db.QueryRow(busFareQuery, IdBus).Scan(&fare)
+	return fare, err
+}
+
+// getRouteCode returns the code of an active route, which is also stored as the
+// route name of the buses assigned to it so passes keep matching by route.
+func getRouteCode(IdRoute string) (string, error) {
+	var code string
+	err := db.QueryRow("SELECT code FROM routes WHERE id = $1 AND active IS TRUE", IdRoute).Scan(&code)
+	return code, err
+}
+
+func scanRoute(row interface{ Scan(...any) error }) (Route, error) {
+	var r Route
+	var geometry []byte
+	var fare sql.NullFloat64
+
+	if err := row.Scan(&r.ID, &r.Code, &r.Name, &r.Direction, &r.Color, &geometry, &fare, &r.TapOut, &r.Active); err != nil {
+		return r, err
+	}
+
+	if fare.Valid {
+		r.Fare = &fare.Float64
+	}
+
+	if len(geometry) > 0 {
+		if err := json.Unmarshal(geometry, &r.Geometry); err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+func getRoutes(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT id, code, name, direction, color, geometry, fare, tap_out, active FROM routes WHERE active IS TRUE OR $1 ORDER BY code, direction", c.GetBool("admin"))
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var routes []Route
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			log.Println(err)
+		}
+		routes = append(routes, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, routes)
+}
+
+// getRoute returns the route with the last known position of each active bus
+// assigned to it.
+func getRoute(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	row := db.QueryRow("SELECT id, code, name, direction, color, geometry, fare, tap_out, active FROM routes WHERE id = $1", id)
+
+	route, err := scanRoute(row)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+		}
+	}
+
+	rows_bus, err := db.Query("SELECT b.id, b.name, COALESCE(r.fare, b.fare), b.route, b.id_route, bs.lat, bs.lng, bs.date FROM bus b JOIN routes r ON r.id = b.id_route INNER JOIN (SELECT DISTINCT ON (id_bus) * FROM bus_stats ORDER BY id_bus, date::timestamptz DESC) bs ON b.id = bs.id_bus WHERE b.id_route = $1 AND b.active IS TRUE", id)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows_bus.Close()
+
+	occupancies, err := occupancyModel.Estimate()
+	if err != nil {
+		log.Println(err)
+	}
+
+	for rows_bus.Next() {
+		var b BusAndStats
+		err := rows_bus.Scan(&b.ID, &b.Name, &b.Fare, &b.Route, &b.IdRoute, &b.Lat, &b.Lng, &b.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		if occupancy, ok := occupancies[b.ID]; ok {
+			b.Occupancy = &occupancy
+		}
+		route.Buses = append(route.Buses, b)
+	}
+	err = rows_bus.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, route)
+}
+
+func createRoute(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var route Route
+
+	if err := c.ShouldBindJSON(&route); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if route.Geometry == nil {
+		route.Geometry = []Point{}
+	}
+
+	geometry, err := json.Marshal(route.Geometry)
+	if err != nil {
+		log.Println(err)
+	}
+
+	id_route := uuid.New()
+
+	_, err = db.Exec("INSERT INTO routes (id, code, name, direction, color, geometry, fare, tap_out, active) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, TRUE)", id_route, strings.TrimSpace(route.Code), strings.TrimSpace(route.Name), route.Direction, strings.ToUpper(route.Color), string(geometry), route.Fare, route.TapOut)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Route already exists with code " + route.Code + " and direction " + string(route.Direction)})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create route"})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Route successfully created!", "id": id_route})
+}
+
+// updateRoute replaces the route. Assigned buses follow the new code and their
+// validators are told about the new fare when it changes.
+func updateRoute(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var route Route
+
+	if err := c.ShouldBindJSON(&route); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if route.Geometry == nil {
+		route.Geometry = []Point{}
+	}
+
+	geometry, err := json.Marshal(route.Geometry)
+	if err != nil {
+		log.Println(err)
+	}
+
+	oldFares := getRouteBusFares(id)
+
+	result, err := db.Exec("UPDATE routes SET code = $1, name = $2, direction = $3, color = $4, geometry = $5, fare = $6, tap_out = $7 WHERE id = $8 AND active IS TRUE", strings.TrimSpace(route.Code), strings.TrimSpace(route.Name), route.Direction, strings.ToUpper(route.Color), string(geometry), route.Fare, route.TapOut, id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Route already exists with code " + route.Code + " and direction " + string(route.Direction)})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	if _, err := db.Exec("UPDATE bus SET route = $1 WHERE id_route = $2", strings.TrimSpace(route.Code), id); err != nil {
+		log.Println(err)
+	}
+
+	notifyFareChanges(oldFares, getRouteBusFares(id))
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Route successfully updated!"})
+}
+
+// deactivateRoute keeps the buses assigned, they go back to their own fare.
+func deactivateRoute(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	oldFares := getRouteBusFares(id)
+
+	result, err := db.Exec("UPDATE routes SET active = FALSE WHERE id = $1", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	notifyFareChanges(oldFares, getRouteBusFares(id))
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Route successfully deactivated!"})
+}
+
+// getRouteBusFares maps each bus assigned to the route to the fare it charges.
+func getRouteBusFares(IdRoute string) map[string]float64 {
+	fares := make(map[string]float64)
+
+	rows, err := db.Query("SELECT b.id, COALESCE(r.fare, b.fare) FROM bus b LEFT JOIN routes r ON r.id = b.id_route AND r.active IS TRUE WHERE b.id_route = $1 AND b.deleted_at IS NULL", IdRoute)
+	if err != nil {
+		log.Println(err)
+		return fares
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var fare float64
+		if err := rows.Scan(&id, &fare); err != nil {
+			log.Println(err)
+			continue
+		}
+		fares[id] = fare
+	}
+
+	return fares
+}
+
+func notifyFareChanges(oldFares map[string]float64, newFares map[string]float64) {
+	for id, fare := range newFares {
+		if old, ok := oldFares[id]; ok && old != fare {
+			notifyFareChange(id, old, fare)
+		}
+	}
+}
+
+func notifyFareChange(IdBus string, oldFare float64, fare float64) {
+	hub.BroadcastToID(IdBus, gin.H{"type": "fare_updated", "old_fare": oldFare, "fare": fare, "message": "Tarifa atualizada: R$ " + fmt.Sprintf("%.2f", fare)})
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ServiceCalendar tells on which days the trips of a service run. On holidays
+// only the services flagged for holidays run, whatever the day of the week.
+type ServiceCalendar struct {
+	ID        string `json:"id" binding:"required,lte=64"`
+	Monday    bool   `json:"monday"`
+	Tuesday   bool   `json:"tuesday"`
+	Wednesday bool   `json:"wednesday"`
+	Thursday  bool   `json:"thursday"`
+	Friday    bool   `json:"friday"`
+	Saturday  bool   `json:"saturday"`
+	Sunday    bool   `json:"sunday"`
+	Holidays  bool   `json:"holidays"`
+	StartDate string `json:"start_date" binding:"required,datetime=2006-01-02"`
+	EndDate   string `json:"end_date" binding:"required,datetime=2006-01-02"`
+}
+
+type Holiday struct {
+	Date string `json:"date" binding:"required,datetime=2006-01-02"`
+	Name string `json:"name" binding:"required,lte=100"`
+}
+
+type TripStopTime struct {
+	IdStop    string `json:"id_stop"`
+	Sequence  int    `json:"sequence"`
+	Arrival   string `json:"arrival_time,omitempty"`
+	Departure string `json:"departure_time,omitempty"`
+}
+
+// TimetableTrip is written with one time per stop of the route, in sequence,
+// left empty where the trip has no fixed time. It is read back as stop times.
+type TimetableTrip struct {
+	ID        string         `json:"id,omitempty"`
+	IdService string         `json:"id_service" binding:"required"`
+	Headsign  string         `json:"headsign" binding:"lte=100"`
+	Times     []string       `json:"times,omitempty" binding:"required,min=2"`
+	StopTimes []TripStopTime `json:"stop_times,omitempty"`
+}
+
+type Timetable struct {
+	Trips []TimetableTrip `json:"trips" binding:"required,dive"`
+}
+
+// serviceRunsCondition is true when the service calendar sc of the trip t runs
+// on the YYYY-MM-DD date given by param. Trips without a calendar run every day.
+func serviceRunsCondition(param string) string {
+	return fmt.Sprintf("(t.id_service IS NULL OR (sc.start_date <= %[1]s AND sc.end_date >= %[1]s AND CASE WHEN EXISTS (SELECT 1 FROM holidays h WHERE h.date = %[1]s) THEN sc.holidays ELSE (ARRAY[sc.monday, sc.tuesday, sc.wednesday, sc.thursday, sc.friday, sc.saturday, sc.sunday])[EXTRACT(ISODOW FROM %[1]s::date)::int] END))", param)
+}
+
+// parseTimetableTime accepts HH:MM or HH:MM:SS, past 24:00 for trips after
+// midnight, and returns it in the HH:MM:SS form of GTFS.
+func parseTimetableTime(value string) (string, int, error) {
+	if strings.Count(value, ":") == 1 {
+		value += ":00"
+	}
+
+	seconds, err := parseGTFSTime(value)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return formatGTFSTime(seconds), seconds, nil
+}
+
+func scanServiceCalendar(row interface{ Scan(...any) error }) (ServiceCalendar, error) {
+	var sc ServiceCalendar
+	err := row.Scan(&sc.ID, &sc.Monday, &sc.Tuesday, &sc.Wednesday, &sc.Thursday, &sc.Friday, &sc.Saturday, &sc.Sunday, &sc.Holidays, &sc.StartDate, &sc.EndDate)
+	return sc, err
+}
+
+func getServiceCalendars(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT id, monday, tuesday, wednesday, thursday, friday, saturday, sunday, holidays, start_date, end_date FROM service_calendars ORDER BY id")
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var calendars []ServiceCalendar
+	for rows.Next() {
+		sc, err := scanServiceCalendar(rows)
+		if err != nil {
+			log.Println(err)
+		}
+		calendars = append(calendars, sc)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, calendars)
+}
+
+func bindServiceCalendar(c *gin.Context) (ServiceCalendar, bool) {
+	var sc ServiceCalendar
+
+	if err := c.ShouldBindJSON(&sc); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return sc, false
+	}
+
+	// Dates are YYYY-MM-DD so they compare as text
+	if sc.EndDate < sc.StartDate {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Field 'end_date' must not be before 'start_date'"})
+		return sc, false
+	}
+
+	return sc, true
+}
+
+func createServiceCalendar(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	sc, ok := bindServiceCalendar(c)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO service_calendars (id, monday, tuesday, wednesday, thursday, friday, saturday, sunday, holidays, start_date, end_date) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", strings.TrimSpace(sc.ID), sc.Monday, sc.Tuesday, sc.Wednesday, sc.Thursday, sc.Friday, sc.Saturday, sc.Sunday, sc.Holidays, sc.StartDate, sc.EndDate)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Service calendar already exists with ID: " + sc.ID})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create service calendar"})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Service calendar successfully created!", "id": strings.TrimSpace(sc.ID)})
+}
+
+// updateServiceCalendar replaces the days and dates of the calendar, its ID
+// cannot change.
+func updateServiceCalendar(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+
+	sc, ok := bindServiceCalendar(c)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("UPDATE service_calendars SET monday = $1, tuesday = $2, wednesday = $3, thursday = $4, friday = $5, saturday = $6, sunday = $7, holidays = $8, start_date = $9, end_date = $10 WHERE id = $11", sc.Monday, sc.Tuesday, sc.Wednesday, sc.Thursday, sc.Friday, sc.Saturday, sc.Sunday, sc.Holidays, sc.StartDate, sc.EndDate, id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Service calendar successfully updated!"})
+}
+
+func deleteServiceCalendar(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+
+	var used bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM trips WHERE id_service = $1)", id).Scan(&used); err != nil {
+		log.Println(err)
+	}
+
+	if used {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Service calendar is used by trips, ID: " + id})
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM service_calendars WHERE id = $1", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot delete data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Service calendar successfully deleted!"})
+}
+
+func getHolidays(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT date, name FROM holidays ORDER BY date")
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var holidays []Holiday
+	for rows.Next() {
+		var h Holiday
+		err := rows.Scan(&h.Date, &h.Name)
+		if err != nil {
+			log.Println(err)
+		}
+		holidays = append(holidays, h)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, holidays)
+}
+
+func createHoliday(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var holiday Holiday
+
+	if err := c.ShouldBindJSON(&holiday); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO holidays (date, name) VALUES ($1, $2)", holiday.Date, strings.TrimSpace(holiday.Name))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Holiday already exists on " + holiday.Date})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create holiday"})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Holiday successfully created!", "date": holiday.Date})
+}
+
+func deleteHoliday(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	date := c.Param("date")
+
+	result, err := db.Exec("DELETE FROM holidays WHERE date = $1", date)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot delete holiday on " + date})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No holiday found on " + date})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Holiday successfully deleted!"})
+}
+
+// getRouteTimetable returns the trips of the route with their stop times. With
+// a date only the trips running on that day are returned.
+func getRouteTimetable(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	condition := "TRUE"
+	args := []any{id}
+
+	if date := c.Query("date"); date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Date must be in the YYYY-MM-DD format"})
+			return
+		}
+		condition = serviceRunsCondition("$2")
+		args = append(args, date)
+	}
+
+	rows, err := db.Query("SELECT t.id, COALESCE(t.id_service, ''), COALESCE(t.headsign, ''), st.id_stop, st.sequence, COALESCE(st.arrival_time, ''), COALESCE(st.departure_time, '') FROM trips t JOIN trip_stop_times st ON st.id_trip = t.id LEFT JOIN service_calendars sc ON sc.id = t.id_service WHERE t.id_route = $1 AND "+condition+" ORDER BY (SELECT MIN(COALESCE(departure_time, arrival_time)) FROM trip_stop_times WHERE id_trip = t.id), t.id, st.sequence", args...)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot get timetable for route with ID: " + id})
+		return
+	}
+	defer rows.Close()
+
+	trips := []TimetableTrip{}
+	for rows.Next() {
+		var t TimetableTrip
+		var st TripStopTime
+		if err := rows.Scan(&t.ID, &t.IdService, &t.Headsign, &st.IdStop, &st.Sequence, &st.Arrival, &st.Departure); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if len(trips) == 0 || trips[len(trips)-1].ID != t.ID {
+			trips = append(trips, t)
+		}
+		last := &trips[len(trips)-1]
+		last.StopTimes = append(last.StopTimes, st)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, trips)
+}
+
+// updateRouteTimetable replaces every trip of the route. Times follow the stop
+// sequence of the route and must not go back in time.
+func updateRouteTimetable(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var timetable Timetable
+
+	if err := c.ShouldBindJSON(&timetable); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if _, err := getRouteCode(id); err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+			return
+		}
+	}
+
+	stops, err := getRouteStops(id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	services := make(map[string]bool)
+	rows, err := db.Query("SELECT id FROM service_calendars")
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+	for rows.Next() {
+		var service string
+		if err := rows.Scan(&service); err != nil {
+			rows.Close()
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+			return
+		}
+		services[service] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	for i, t := range timetable.Trips {
+		if !services[t.IdService] {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Trip %d: unknown service calendar '%s'", i+1, t.IdService)})
+			return
+		}
+
+		if len(t.Times) != len(stops) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Trip %d: expected %d times, one per stop of the route", i+1, len(stops))})
+			return
+		}
+
+		if t.Times[0] == "" || t.Times[len(t.Times)-1] == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Trip %d: first and last stop must have times", i+1)})
+			return
+		}
+
+		previous := -1
+		for j, value := range t.Times {
+			if value == "" {
+				continue
+			}
+
+			normalized, seconds, err := parseTimetableTime(value)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Trip %d: invalid time '%s'", i+1, value)})
+				return
+			}
+
+			if seconds < previous {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Trip %d: time '%s' is before the previous stop", i+1, value)})
+				return
+			}
+			previous = seconds
+
+			timetable.Trips[i].Times[j] = normalized
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := replaceRouteTrips(tx, id, stops, timetable.Trips); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Route timetable successfully updated!", "trips": len(timetable.Trips)})
+}
+
+func replaceRouteTrips(tx *sql.Tx, IdRoute string, stops []RouteStop, trips []TimetableTrip) error {
+	if _, err := tx.Exec("DELETE FROM trip_stop_times WHERE id_trip IN (SELECT id FROM trips WHERE id_route = $1)", IdRoute); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM trips WHERE id_route = $1", IdRoute); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO trip_stop_times (id_trip, id_stop, sequence, arrival_time, departure_time) VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($4, ''))")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, t := range trips {
+		id_trip := uuid.New().String()
+
+		if _, err := tx.Exec("INSERT INTO trips (id, id_route, id_service, headsign, shape_id) VALUES ($1, $2, $3, $4, '')", id_trip, IdRoute, t.IdService, strings.TrimSpace(t.Headsign)); err != nil {
+			return err
+		}
+
+		for i, s := range stops {
+			if _, err := stmt.Exec(id_trip, s.ID, s.Sequence, t.Times[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type Stop struct {
+	ID                string  `json:"id,omitempty"`
+	Code              string  `json:"code" binding:"lte=20"`
+	Name              string  `json:"name" binding:"required,lte=100"`
+	Lat               float64 `json:"lat" binding:"required,gte=-90,lte=90"`
+	Lng               float64 `json:"lng" binding:"required,gte=-180,lte=180"`
+	Wheelchair        bool    `json:"wheelchair"`
+	TactilePaving     bool    `json:"tactile_paving"`
+	AudioAnnouncement bool    `json:"audio_announcement"`
+	Active            bool    `json:"active"`
+}
+
+func (s Stop) Point() Point {
+	return Point{Lat: s.Lat, Lng: s.Lng}
+}
+
+type RouteStop struct {
+	Stop
+	Sequence int     `json:"sequence"`
+	Distance float64 `json:"distance"`
+}
+
+type RouteStops struct {
+	Stops []string `json:"stops" binding:"required,min=2,dive,uuid"`
+}
+
+// distanceMeters is the great-circle distance between two points.
+func distanceMeters(a Point, b Point) float64 {
+	const earthRadius = 6371000
+
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// getRouteStops returns the active stops of a route in order, each with the
+// distance in meters from the first stop measured stop to stop.
+func getRouteStops(IdRoute string) ([]RouteStop, error) {
+	rows, err := db.Query("SELECT s.id, COALESCE(s.code, ''), s.name, s.lat, s.lng, s.wheelchair, s.tactile_paving, s.audio_announcement, s.active, rs.sequence FROM route_stops rs JOIN stops s ON s.id = rs.id_stop WHERE rs.id_route = $1 AND s.active IS TRUE ORDER BY rs.sequence", IdRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stops []RouteStop
+	for rows.Next() {
+		var s RouteStop
+		if err := rows.Scan(&s.ID, &s.Code, &s.Name, &s.Lat, &s.Lng, &s.Wheelchair, &s.TactilePaving, &s.AudioAnnouncement, &s.Active, &s.Sequence); err != nil {
+			return nil, err
+		}
+
+		if len(stops) > 0 {
+			prev := stops[len(stops)-1]
+			s.Distance = prev.Distance + distanceMeters(prev.Point(), s.Point())
+		}
+
+		stops = append(stops, s)
+	}
+
+	return stops, rows.Err()
+}
+
+func getStops(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT id, COALESCE(code, ''), name, lat, lng, wheelchair, tactile_paving, audio_announcement, active FROM stops WHERE active IS TRUE OR $1 ORDER BY name", c.GetBool("admin"))
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var stops []Stop
+	for rows.Next() {
+		var s Stop
+		err := rows.Scan(&s.ID, &s.Code, &s.Name, &s.Lat, &s.Lng, &s.Wheelchair, &s.TactilePaving, &s.AudioAnnouncement, &s.Active)
+		if err != nil {
+			log.Println(err)
+		}
+		stops = append(stops, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, stops)
+}
+
+// getStop returns the stop together with the active routes that serve it.
+func getStop(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var stop Stop
+	row := db.QueryRow("SELECT id, COALESCE(code, ''), name, lat, lng, wheelchair, tactile_paving, audio_announcement, active FROM stops WHERE id = $1", id)
+
+	err := row.Scan(&stop.ID, &stop.Code, &stop.Name, &stop.Lat, &stop.Lng, &stop.Wheelchair, &stop.TactilePaving, &stop.AudioAnnouncement, &stop.Active)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+		}
+	}
+
+	rows, err := db.Query("SELECT r.id, r.code, r.name, r.direction, r.color, r.geometry, r.fare, r.tap_out, r.active FROM route_stops rs JOIN routes r ON r.id = rs.id_route WHERE rs.id_stop = $1 AND r.active IS TRUE ORDER BY r.code, r.direction", id)
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var routes []Route
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			log.Println(err)
+		}
+		r.Geometry = nil
+		routes = append(routes, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"stop": stop, "routes": routes})
+}
+
+func getStopsByRoute(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	if _, err := getRouteCode(id); err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+		}
+	}
+
+	stops, err := getRouteStops(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, stops)
+}
+
+func createStop(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var stop Stop
+
+	if err := c.ShouldBindJSON(&stop); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	id_stop := uuid.New()
+
+	_, err := db.Exec("INSERT INTO stops (id, code, name, lat, lng, wheelchair, tactile_paving, audio_announcement, active) VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8, TRUE)", id_stop, strings.TrimSpace(stop.Code), strings.TrimSpace(stop.Name), stop.Lat, stop.Lng, stop.Wheelchair, stop.TactilePaving, stop.AudioAnnouncement)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Stop already exists with code: " + stop.Code})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create stop"})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Stop successfully created!", "id": id_stop})
+}
+
+func updateStop(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var stop Stop
+
+	if err := c.ShouldBindJSON(&stop); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	result, err := db.Exec("UPDATE stops SET code = NULLIF($1, ''), name = $2, lat = $3, lng = $4, wheelchair = $5, tactile_paving = $6, audio_announcement = $7 WHERE id = $8 AND active IS TRUE", strings.TrimSpace(stop.Code), strings.TrimSpace(stop.Name), stop.Lat, stop.Lng, stop.Wheelchair, stop.TactilePaving, stop.AudioAnnouncement, id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Stop already exists with code: " + stop.Code})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Stop successfully updated!"})
+}
+
+// deactivateStop hides the stop from every route without touching the stop
+// sequences, so reactivating it restores them.
+func deactivateStop(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE stops SET active = FALSE WHERE id = $1", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Stop successfully deactivated!"})
+}
+
+// activateStop puts a deactivated stop back on the routes that serve it.
+func activateStop(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE stops SET active = TRUE WHERE id = $1", id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Another active stop already uses the code of stop with ID: " + id})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Stop successfully activated!"})
+}
+
+// updateRouteStops replaces the stop sequence of a route with the stops in
+// the order they are served.
+func updateRouteStops(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var sequence RouteStops
+
+	if err := c.ShouldBindJSON(&sequence); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if _, err := getRouteCode(id); err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+		}
+	}
+
+	var found int
+	if err := db.QueryRow("SELECT COUNT(*) FROM stops WHERE id = ANY($1::uuid[]) AND active IS TRUE", pq.Array(sequence.Stops)).Scan(&found); err != nil {
+		log.Println(err)
+	}
+
+	// Loop routes may serve the same stop more than once
+	distinct := make(map[string]bool)
+	for _, s := range sequence.Stops {
+		distinct[s] = true
+	}
+
+	if found != len(distinct) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Every stop must exist and be active"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM route_stops WHERE id_route = $1", id); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	for i, s := range sequence.Stops {
+		if _, err := tx.Exec("INSERT INTO route_stops (id_route, id_stop, sequence) VALUES ($1, $2, $3)", id, s, i+1); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	stops, err := getRouteStops(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	gtfsCache.Invalidate()
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Route stops successfully updated!", "stops": stops})
+}
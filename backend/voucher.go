@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+type VoucherInfo struct {
+	ID             string  `json:"id,omitempty"`
+	Code           string  `json:"code" binding:"required,gte=4,lte=32,alphanum"`
+	Value          float64 `json:"value" binding:"required,gt=0"`
+	ExpiresAt      string  `json:"expires_at" binding:"required"`
+	MaxUses        int     `json:"max_uses" binding:"gte=0"`
+	MaxUsesPerUser int     `json:"max_uses_per_user" binding:"gte=0"`
+	Uses           int     `json:"uses"`
+	Active         bool    `json:"active"`
+	Date           string  `json:"date,omitempty"`
+}
+
+type VoucherRedeem struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func getVouchers(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT id, code, value, expires_at, max_uses, max_uses_per_user, uses, active, date FROM vouchers ORDER BY date DESC")
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var vouchers []VoucherInfo
+	for rows.Next() {
+		var v VoucherInfo
+		err := rows.Scan(&v.ID, &v.Code, &v.Value, &v.ExpiresAt, &v.MaxUses, &v.MaxUsesPerUser, &v.Uses, &v.Active, &v.Date)
+		if err != nil {
+			log.Println(err)
+		}
+		vouchers = append(vouchers, v)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, vouchers)
+}
+
+func createVoucher(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var voucher VoucherInfo
+
+	if err := c.ShouldBindJSON(&voucher); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+
+	expiresAt, err := time.Parse(time.RFC3339, voucher.ExpiresAt)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Field 'expires_at' must be a RFC3339 date"})
+		return
+	}
+
+	if expiresAt.Before(time.Now()) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Field 'expires_at' must be in the future"})
+		return
+	}
+
+	code := strings.ToUpper(voucher.Code)
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM vouchers WHERE code = $1)", code).Scan(&exists); err != nil {
+		log.Println(err)
+	}
+
+	if exists {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Voucher code already exists: " + code})
+		return
+	}
+
+	stmt, err := db.Prepare("INSERT INTO vouchers (id, code, value, expires_at, max_uses, max_uses_per_user, uses, active, date) VALUES ($1, $2, $3, $4, $5, $6, 0, TRUE, $7)")
+	if err != nil {
+		log.Println(err)
+	}
+	defer stmt.Close()
+
+	id_voucher := uuid.New()
+	time := time.Now().In(loc)
+
+	if _, err := stmt.Exec(id_voucher, code, voucher.Value, createDateString(expiresAt.In(loc)), voucher.MaxUses, voucher.MaxUsesPerUser, createDateString(time)); err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Voucher successfully created!", "id": id_voucher, "code": code})
+}
+
+func deactivateVoucher(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE vouchers SET active = FALSE WHERE id = $1", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Voucher successfully deactivated!"})
+}
+
+func redeemVoucher(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var redeem VoucherRedeem
+
+	if err := c.ShouldBindJSON(&redeem); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(redeem.Code))
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem voucher"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the voucher row serializes concurrent redemptions of the same code,
+	// so the use counts read below cannot change before the commit
+	var voucher VoucherInfo
+	row := tx.QueryRow("SELECT id, code, value, expires_at, max_uses, max_uses_per_user, uses, active FROM vouchers WHERE code = $1 FOR UPDATE", code)
+
+	err_voucher := row.Scan(&voucher.ID, &voucher.Code, &voucher.Value, &voucher.ExpiresAt, &voucher.MaxUses, &voucher.MaxUsesPerUser, &voucher.Uses, &voucher.Active)
+
+	if err_voucher != nil {
+		if err_voucher == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Cupom inválido"})
+		} else {
+			log.Println(err_voucher)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem voucher"})
+		}
+		return
+	}
+
+	if !voucher.Active {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "Cupom desativado"})
+		return
+	}
+
+	expiresAt, err := parseDateString(voucher.ExpiresAt)
+	if err != nil || time.Now().After(expiresAt) {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "Cupom expirado"})
+		return
+	}
+
+	if voucher.MaxUses > 0 && voucher.Uses >= voucher.MaxUses {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "Cupom esgotado"})
+		return
+	}
+
+	if voucher.MaxUsesPerUser > 0 {
+		var userUses int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM voucher_redemptions WHERE id_voucher = $1 AND id_user = $2", voucher.ID, IdUserToken).Scan(&userUses); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem voucher"})
+			return
+		}
+
+		if userUses >= voucher.MaxUsesPerUser {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Você já utilizou este cupom"})
+			return
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE vouchers SET uses = uses + 1 WHERE id = $1", voucher.ID); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem voucher"})
+		return
+	}
+
+	balance, err := creditWalletUserTx(tx, IdUserToken, PersonalWallet, voucher.Value, Voucher)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem voucher"})
+		return
+	}
+
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	if _, err := tx.Exec("INSERT INTO voucher_redemptions (id, id_voucher, id_user, value, date) VALUES ($1, $2, $3, $4, $5)", uuid.New(), voucher.ID, IdUserToken, voucher.Value, createDateString(time)); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem voucher"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot redeem voucher"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Cupom resgatado com sucesso!", "value": voucher.Value, "balance": balance})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type WalletType string
+
+const (
+	PersonalWallet       WalletType = "PERSONAL"
+	ValeTransporteWallet WalletType = "VALE_TRANSPORTE"
+)
+
+// Wallets are spent in ascending priority order, so fare-only money
+// (vale-transporte) goes before the rider's own credit.
+var walletPriority = map[WalletType]int{
+	ValeTransporteWallet: 0,
+	PersonalWallet:       1,
+}
+
+type Wallet struct {
+	ID       string     `json:"id"`
+	IdUser   string     `json:"id_user,omitempty"`
+	Type     WalletType `json:"type"`
+	Balance  float64    `json:"balance"`
+	Priority int        `json:"priority"`
+}
+
+type WalletDebit struct {
+	IdWallet   string     `json:"id_wallet"`
+	Type       WalletType `json:"type"`
+	Value      float64    `json:"value"`
+	OldBalance float64    `json:"old_balance"`
+	Balance    float64    `json:"balance"`
+}
+
+var ErrInsufficientBalance = fmt.Errorf("insufficient balance")
+
+// dbExecutor is implemented by both *sql.DB and *sql.Tx, so the wallet helpers
+// can run on their own or as part of the transaction of the caller.
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// ensureWalletUser creates the wallet if the user does not have it yet. The
+// personal wallet is seeded from the legacy users.balance column.
+func ensureWalletUser(IdUser string, walletType WalletType) (Wallet, error) {
+	return ensureWalletUserTx(db, IdUser, walletType)
+}
+
+func ensureWalletUserTx(q dbExecutor, IdUser string, walletType WalletType) (Wallet, error) {
+	var err error
+	if walletType == PersonalWallet {
+		_, err = q.Exec("INSERT INTO wallets (id, id_user, type, balance, priority) SELECT $1, id, $2, balance, $3 FROM users WHERE id = $4 ON CONFLICT (id_user, type) DO NOTHING", uuid.New(), walletType, walletPriority[walletType], IdUser)
+	} else {
+		_, err = q.Exec("INSERT INTO wallets (id, id_user, type, balance, priority) VALUES ($1, $2, $3, 0, $4) ON CONFLICT (id_user, type) DO NOTHING", uuid.New(), IdUser, walletType, walletPriority[walletType])
+	}
+	if err != nil {
+		return Wallet{}, err
+	}
+
+	var wallet Wallet
+	row := q.QueryRow("SELECT id, id_user, type, balance, priority FROM wallets WHERE id_user = $1 AND type = $2", IdUser, walletType)
+
+	if err := row.Scan(&wallet.ID, &wallet.IdUser, &wallet.Type, &wallet.Balance, &wallet.Priority); err != nil {
+		return Wallet{}, err
+	}
+
+	return wallet, nil
+}
+
+func getWalletsUser(IdUser string) ([]Wallet, error) {
+	if _, err := ensureWalletUser(IdUser, PersonalWallet); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, id_user, type, balance, priority FROM wallets WHERE id_user = $1 ORDER BY priority", IdUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wallets []Wallet
+	for rows.Next() {
+		var w Wallet
+		if err := rows.Scan(&w.ID, &w.IdUser, &w.Type, &w.Balance, &w.Priority); err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, w)
+	}
+
+	return wallets, rows.Err()
+}
+
+func getBalanceUser(IdUser string) (float64, error) {
+	wallets, err := getWalletsUser(IdUser)
+	if err != nil {
+		return 0, err
+	}
+
+	var balance float64
+	for _, w := range wallets {
+		balance += w.Balance
+	}
+
+	return balance, nil
+}
+
+func insertBalanceHistory(q dbExecutor, IdUser string, IdWallet string, oldBalance float64, balance float64, value float64, balanceType BalanceHistoryType) error {
+	loc := time.FixedZone("BRT", -3*60*60)
+	time := time.Now().In(loc)
+
+	_, err := q.Exec("INSERT INTO balance_history (id, id_user, id_wallet, old_balance, balance, value, type, date) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", uuid.New(), IdUser, IdWallet, oldBalance, balance, value, balanceType, createDateString(time))
+	return err
+}
+
+// creditWalletUser adds value (negative to debit) to one wallet of the user and
+// records it in the balance history. Debits never take a wallet below zero.
+func creditWalletUser(IdUser string, walletType WalletType, value float64, balanceType BalanceHistoryType) (float64, error) {
+	return creditWalletUserTx(db, IdUser, walletType, value, balanceType)
+}
+
+func creditWalletUserTx(q dbExecutor, IdUser string, walletType WalletType, value float64, balanceType BalanceHistoryType) (float64, error) {
+	wallet, err := ensureWalletUserTx(q, IdUser, walletType)
+	if err != nil {
+		return 0, err
+	}
+
+	var balance float64
+	row := q.QueryRow("UPDATE wallets SET balance = balance + $1 WHERE id = $2 AND balance + $1 >= 0 RETURNING balance", value, wallet.ID)
+
+	if err := row.Scan(&balance); err != nil {
+		if value < 0 {
+			return 0, ErrInsufficientBalance
+		}
+		return 0, err
+	}
+
+	if err := insertBalanceHistory(q, IdUser, wallet.ID, (balance - value), balance, value, balanceType); err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// debitFareUser charges a fare across the user's wallets following their
+// priority. The wallets are locked for the rest of the transaction, so the
+// caller commits the debits together with the fare they pay for. Nothing is
+// debited when the wallets together cannot cover it.
+func debitFareUser(tx *sql.Tx, IdUser string, fare float64) ([]WalletDebit, error) {
+	if _, err := ensureWalletUserTx(tx, IdUser, PersonalWallet); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT id, id_user, type, balance, priority FROM wallets WHERE id_user = $1 ORDER BY priority FOR UPDATE", IdUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wallets []Wallet
+	var total float64
+	for rows.Next() {
+		var w Wallet
+		if err := rows.Scan(&w.ID, &w.IdUser, &w.Type, &w.Balance, &w.Priority); err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, w)
+		total += w.Balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if total < fare {
+		return nil, ErrInsufficientBalance
+	}
+
+	var debits []WalletDebit
+	remaining := fare
+
+	for _, w := range wallets {
+		if remaining <= 0 {
+			break
+		}
+		if w.Balance <= 0 {
+			continue
+		}
+
+		value := min(w.Balance, remaining)
+
+		var balance float64
+		row := tx.QueryRow("UPDATE wallets SET balance = balance - $1 WHERE id = $2 RETURNING balance", value, w.ID)
+
+		if err := row.Scan(&balance); err != nil {
+			return nil, err
+		}
+
+		if err := insertBalanceHistory(tx, IdUser, w.ID, (balance + value), balance, -value, FarePayment); err != nil {
+			return nil, err
+		}
+
+		debits = append(debits, WalletDebit{IdWallet: w.ID, Type: w.Type, Value: value, OldBalance: (balance + value), Balance: balance})
+		remaining -= value
+	}
+
+	return debits, nil
+}
+
+func getWalletsByUser(c *gin.Context) {
+	v, exists := c.Get("token")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	token, ok := v.(string)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+		return
+	}
+
+	IdUserToken, err := getUserIDFromToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot get ID with this TOKEN"})
+		return
+	}
+
+	wallets, err := getWalletsUser(IdUserToken)
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, wallets)
+}
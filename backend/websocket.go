@@ -14,15 +14,29 @@ type WSMessage struct {
 	Data any    `json:"data"`
 }
 
+// wsClient serializes the writes to a connection, which gorilla/websocket
+// does not allow to happen concurrently.
+type wsClient struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *wsClient) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
 type Hub struct {
-	clientsByID map[string]map[*websocket.Conn]bool
+	clientsByID map[string]map[*wsClient]bool
 	mu          sync.Mutex
 	upgrader    websocket.Upgrader
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		clientsByID: make(map[string]map[*websocket.Conn]bool),
+		clientsByID: make(map[string]map[*wsClient]bool),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -47,11 +61,13 @@ func (h *Hub) HandleWS(cCtx *ginContextAdapter) {
 		return
 	}
 
+	client := &wsClient{conn: conn}
+
 	h.mu.Lock()
 	if h.clientsByID[id] == nil {
-		h.clientsByID[id] = make(map[*websocket.Conn]bool)
+		h.clientsByID[id] = make(map[*wsClient]bool)
 	}
-	h.clientsByID[id][conn] = true
+	h.clientsByID[id][client] = true
 	h.mu.Unlock()
 
 	// Listen for close
@@ -63,15 +79,19 @@ func (h *Hub) HandleWS(cCtx *ginContextAdapter) {
 
 	// Remove on disconnect
 	h.mu.Lock()
-	delete(h.clientsByID[id], conn)
+	delete(h.clientsByID[id], client)
 	h.mu.Unlock()
 
 	conn.Close()
 }
 
 func (h *Hub) BroadcastToID(id string, msg any) {
+	// Copy the clients so the map is not read while HandleWS changes it
 	h.mu.Lock()
-	conns := h.clientsByID[id]
+	clients := make([]*wsClient, 0, len(h.clientsByID[id]))
+	for client := range h.clientsByID[id] {
+		clients = append(clients, client)
+	}
 	h.mu.Unlock()
 
 	b, err := json.Marshal(msg)
@@ -80,13 +100,13 @@ func (h *Hub) BroadcastToID(id string, msg any) {
 		return
 	}
 
-	for conn := range conns {
-		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+	for _, client := range clients {
+		if err := client.write(b); err != nil {
 			log.Println("ws write:", err)
-			conn.Close()
+			client.conn.Close()
 
 			h.mu.Lock()
-			delete(h.clientsByID[id], conn)
+			delete(h.clientsByID[id], client)
 			h.mu.Unlock()
 		}
 	}
@@ -98,9 +118,9 @@ func (h *Hub) BroadcastAll(msg any) {
 
 	b, _ := json.Marshal(msg)
 
-	for _, conns := range h.clientsByID {
-		for conn := range conns {
-			conn.WriteMessage(websocket.TextMessage, b)
+	for _, clients := range h.clientsByID {
+		for client := range clients {
+			client.write(b)
 		}
 	}
 }
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type Zone struct {
+	ID       string  `json:"id,omitempty"`
+	Code     string  `json:"code" binding:"required,lte=20"`
+	Name     string  `json:"name" binding:"required,lte=100"`
+	Geometry []Point `json:"geometry" binding:"required,min=3,dive"`
+	Active   bool    `json:"active"`
+}
+
+type ZoneFare struct {
+	IdZoneFrom string  `json:"id_zone_from" binding:"required,uuid"`
+	IdZoneTo   string  `json:"id_zone_to" binding:"required,uuid"`
+	Fare       float64 `json:"fare" binding:"required,gt=0"`
+}
+
+type ZoneFares struct {
+	Fares []ZoneFare `json:"fares" binding:"required,dive"`
+}
+
+// Contains reports whether p is inside the zone polygon, by ray casting.
+func (z Zone) Contains(p Point) bool {
+	inside := false
+
+	for i, j := 0, len(z.Geometry)-1; i < len(z.Geometry); j, i = i, i+1 {
+		a, b := z.Geometry[i], z.Geometry[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+func scanZone(row interface{ Scan(...any) error }) (Zone, error) {
+	var z Zone
+	var geometry []byte
+
+	if err := row.Scan(&z.ID, &z.Code, &z.Name, &geometry, &z.Active); err != nil {
+		return z, err
+	}
+
+	if len(geometry) > 0 {
+		if err := json.Unmarshal(geometry, &z.Geometry); err != nil {
+			return z, err
+		}
+	}
+
+	return z, nil
+}
+
+// getZoneAt returns the active zone containing the point. Zones are not
+// expected to overlap, the first match by code wins when they do.
+func getZoneAt(p Point) (Zone, error) {
+	rows, err := db.Query("SELECT id, code, name, geometry, active FROM zones WHERE active IS TRUE ORDER BY code")
+	if err != nil {
+		return Zone{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		z, err := scanZone(rows)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if z.Contains(p) {
+			return z, nil
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return Zone{}, err
+	}
+
+	return Zone{}, sql.ErrNoRows
+}
+
+// getBusZone returns the zone of the last position reported by the bus.
+// Positions older than realtimeMaxAge are not trusted.
+func getBusZone(IdBus string) (Zone, error) {
+	var p Point
+	var date string
+
+	err := db.QueryRow("SELECT lat, lng, date FROM bus_stats WHERE id_bus = $1 ORDER BY date::timestamptz DESC LIMIT 1", IdBus).Scan(&p.Lat, &p.Lng, &date)
+	if err != nil {
+		return Zone{}, err
+	}
+
+	reportedAt, err := parseDateString(date)
+	if err != nil || time.Since(reportedAt) > realtimeMaxAge {
+		return Zone{}, sql.ErrNoRows
+	}
+
+	return getZoneAt(p)
+}
+
+// getZoneFare looks the fare between two zones up in the matrix of the route.
+func getZoneFare(IdRoute string, IdZoneFrom string, IdZoneTo string) (float64, error) {
+	var fare float64
+	err := db.QueryRow("SELECT fare FROM zone_fares WHERE id_route = $1 AND id_zone_from = $2 AND id_zone_to = $3", IdRoute, IdZoneFrom, IdZoneTo).Scan(&fare)
+	return fare, err
+}
+
+// getBusZoneFare returns the fare charged when boarding the bus in the zone it
+// is in now. The destination is unknown at boarding, so it is the highest fare
+// from that zone. Routes without a zone fare matrix keep their flat fare.
+func getBusZoneFare(bus Bus) (float64, Zone, bool) {
+	if bus.IdRoute == "" {
+		return 0, Zone{}, false
+	}
+
+	var priced bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM zone_fares WHERE id_route = $1)", bus.IdRoute).Scan(&priced); err != nil {
+		log.Println(err)
+		return 0, Zone{}, false
+	}
+
+	if !priced {
+		return 0, Zone{}, false
+	}
+
+	zone, err := getBusZone(bus.ID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return 0, Zone{}, false
+	}
+
+	var fare sql.NullFloat64
+	if err := db.QueryRow("SELECT MAX(fare) FROM zone_fares WHERE id_route = $1 AND id_zone_from = $2", bus.IdRoute, zone.ID).Scan(&fare); err != nil {
+		log.Println(err)
+		return 0, Zone{}, false
+	}
+
+	if !fare.Valid {
+		return 0, Zone{}, false
+	}
+
+	return fare.Float64, zone, true
+}
+
+func getZones(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	rows, err := db.Query("SELECT id, code, name, geometry, active FROM zones WHERE active IS TRUE OR $1 ORDER BY code", c.GetBool("admin"))
+	if err != nil {
+		log.Println(err)
+	}
+	defer rows.Close()
+
+	var zones []Zone
+	for rows.Next() {
+		z, err := scanZone(rows)
+		if err != nil {
+			log.Println(err)
+		}
+		zones = append(zones, z)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, zones)
+}
+
+func createZone(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var zone Zone
+
+	if err := c.ShouldBindJSON(&zone); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	geometry, err := json.Marshal(zone.Geometry)
+	if err != nil {
+		log.Println(err)
+	}
+
+	id_zone := uuid.New()
+
+	_, err = db.Exec("INSERT INTO zones (id, code, name, geometry, active) VALUES ($1, $2, $3, $4, TRUE)", id_zone, strings.TrimSpace(zone.Code), strings.TrimSpace(zone.Name), string(geometry))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Zone already exists with code " + zone.Code})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot create zone"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{"message": "Zone successfully created!", "id": id_zone})
+}
+
+func updateZone(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var zone Zone
+
+	if err := c.ShouldBindJSON(&zone); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	geometry, err := json.Marshal(zone.Geometry)
+	if err != nil {
+		log.Println(err)
+	}
+
+	result, err := db.Exec("UPDATE zones SET code = $1, name = $2, geometry = $3 WHERE id = $4 AND active IS TRUE", strings.TrimSpace(zone.Code), strings.TrimSpace(zone.Name), string(geometry), id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Zone already exists with code " + zone.Code})
+			return
+		}
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Zone successfully updated!"})
+}
+
+// deactivateZone keeps the fares of the zone in the route matrices, buses in
+// it just stop matching and charge their flat fare.
+func deactivateZone(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE zones SET active = FALSE WHERE id = $1", id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Zone successfully deactivated!"})
+}
+
+func getRouteZoneFares(IdRoute string) ([]ZoneFare, error) {
+	rows, err := db.Query("SELECT id_zone_from, id_zone_to, fare FROM zone_fares WHERE id_route = $1 ORDER BY id_zone_from, id_zone_to", IdRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fares := []ZoneFare{}
+	for rows.Next() {
+		var f ZoneFare
+		if err := rows.Scan(&f.IdZoneFrom, &f.IdZoneTo, &f.Fare); err != nil {
+			return nil, err
+		}
+		fares = append(fares, f)
+	}
+
+	return fares, rows.Err()
+}
+
+func getZoneFaresByRoute(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	fares, err := getRouteZoneFares(id)
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot get zone fares for route with ID: " + id})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, fares)
+}
+
+// updateRouteZoneFares replaces the zone fare matrix of the route. An empty
+// matrix brings the route back to its flat fare.
+func updateRouteZoneFares(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	id := c.Param("id")
+	err_id := uuid.Validate(id)
+	if err_id != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ID must be a valid UUID"})
+		return
+	}
+
+	var matrix ZoneFares
+
+	if err := c.ShouldBindJSON(&matrix); err != nil {
+		var ValidationErrors validator.ValidationErrors
+		if errors.As(err, &ValidationErrors) {
+			errorMessages := make([]string, len(ValidationErrors))
+			for i, fieldError := range ValidationErrors {
+				errorMessages[i] = fmt.Sprintf("Field '%s' failed validation: %s", fieldError.Field(), fieldError.Tag())
+			}
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": errorMessages})
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "errors": err.Error()})
+		}
+		return
+	}
+
+	if _, err := getRouteCode(id); err != nil {
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No data found with ID: " + id})
+			return
+		} else {
+			log.Println(err)
+		}
+	}
+
+	zones := make(map[string]bool)
+	pairs := make(map[string]bool)
+	for _, f := range matrix.Fares {
+		pair := f.IdZoneFrom + "|" + f.IdZoneTo
+		if pairs[pair] {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Duplicated fare from zone " + f.IdZoneFrom + " to zone " + f.IdZoneTo})
+			return
+		}
+		pairs[pair] = true
+		zones[f.IdZoneFrom] = true
+		zones[f.IdZoneTo] = true
+	}
+
+	ids := make([]string, 0, len(zones))
+	for z := range zones {
+		ids = append(ids, z)
+	}
+
+	var found int
+	if err := db.QueryRow("SELECT COUNT(*) FROM zones WHERE id = ANY($1::uuid[]) AND active IS TRUE", pq.Array(ids)).Scan(&found); err != nil {
+		log.Println(err)
+	}
+
+	if found != len(ids) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Every zone must exist and be active"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM zone_fares WHERE id_route = $1", id); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	for _, f := range matrix.Fares {
+		if _, err := tx.Exec("INSERT INTO zone_fares (id_route, id_zone_from, id_zone_to, fare) VALUES ($1, $2, $3, $4)", id, f.IdZoneFrom, f.IdZoneTo, f.Fare); err != nil {
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Cannot update data with ID: " + id})
+		return
+	}
+
+	fares, err := getRouteZoneFares(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Route zone fares successfully updated!", "fares": fares})
+}
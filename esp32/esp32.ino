@@ -15,6 +15,8 @@ const char* password = "kari2204";
 // URLs das APIs
 // -------------------------------------
 String IdBus = "ec9fc16d-3e6b-44d5-bf54-496c5e81d674";
+// Token do validador, gerado pelo admin em POST /v1/admin/bus/:id/token
+String BusToken = "";
 // String apiUID = "http://192.168.16.121:8080/user/uid";
 String apiUID = "https://api-go-2tfm.onrender.com/v1/bus/fare";
 String apiGPS = "https://api-go-2tfm.onrender.com/v1/bus/ec9fc16d-3e6b-44d5-bf54-496c5e81d674/stats";
@@ -151,6 +153,7 @@ void sendPost(String url, String body) {
   HTTPClient http;
   http.begin(url);
   http.addHeader("Content-Type", "application/json");
+  http.addHeader("Authorization", "Bearer " + BusToken);
 
   int code = http.POST(body);
 